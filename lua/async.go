@@ -0,0 +1,200 @@
+package lua
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// Results of go work done outside of the lua code, see Await
+type Future struct {
+	done    chan struct{}
+	once    sync.Once
+	results []interface{}
+	err     error
+}
+
+// Returns a Future completed by a later call to Complete
+func NewFuture() *Future {
+	return &Future{done: make(chan struct{})}
+}
+
+// Runs f in a new goroutine, the returned Future completes with its results
+func Async(f func() ([]interface{}, error)) *Future {
+	fut := NewFuture()
+	go func() {
+		fut.Complete(f())
+	}()
+	return fut
+}
+
+// Completes f with results or with err, which is raised in the lua code
+// waiting for f. Only the first call has an effect, it can happen in any
+// goroutine.
+func (f *Future) Complete(results []interface{}, err error) {
+	f.once.Do(func() {
+		f.results = results
+		f.err = err
+		close(f.done)
+	})
+}
+
+// Returns a channel closed once f is complete
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+// Suspends the coroutine running the go function until f is complete,
+// lua code then receives the results of f as those of the go function, or
+// the error of f is raised. The go function must return the result of
+// Await:
+//
+//	L.Register("fetch", func(L *lua.State) int {
+//		key := L.ToString(1)
+//		return L.Await(lua.Async(func() ([]interface{}, error) {
+//			v, err := db.Get(key)
+//			return []interface{}{v}, err
+//		}))
+//	})
+//
+// The coroutine must be run by a Scheduler or by Coroutine.Resume, which
+// wait for f. It can't yield if the go function wasn't called from lua
+// code running in a coroutine, a lua error is raised instead. With lua 5.1
+// and LuaJIT the error of f isn't raised, the go function returns nil and
+// the error message.
+func (L *State) Await(f *Future) int {
+	L.awaiting = f
+	return callbackYield
+}
+
+// Waits for f and pushes its results, the error of f is returned
+func (L *State) pushFutureResults(f *Future) (int, error) {
+	<-f.done
+	if f.err != nil {
+		return 0, f.err
+	}
+	if !L.CheckStack(len(f.results)) {
+		return 0, errors.New("lua: too many results")
+	}
+	for i, v := range f.results {
+		if err := L.PushGoValue(v); err != nil {
+			L.Pop(i)
+			return 0, err
+		}
+	}
+	return len(f.results), nil
+}
+
+// Runs coroutines that wait for go work with Await, resuming each one
+// when its Future completes. All the lua code runs in the goroutine
+// calling Run.
+type Scheduler struct {
+	L *State
+
+	ready   []*Task
+	waiting int
+
+	mu        sync.Mutex
+	completed []*Task
+	wake      chan struct{}
+}
+
+// A coroutine run by a Scheduler
+type Task struct {
+	co      *Coroutine
+	args    []interface{}
+	results []interface{}
+	err     error
+	done    bool
+}
+
+// Creates a scheduler for the coroutines of L
+func NewScheduler(L *State) *Scheduler {
+	return &Scheduler{L: L, wake: make(chan struct{}, 1)}
+}
+
+// Adds a coroutine running the function on top of the stack, which is
+// popped, with args. It starts with the next call to Run.
+func (s *Scheduler) Spawn(args ...interface{}) (*Task, error) {
+	co, err := s.L.NewCoroutine()
+	if err != nil {
+		return nil, err
+	}
+	t := &Task{co: co, args: args}
+	s.ready = append(s.ready, t)
+	return t, nil
+}
+
+// Runs the coroutines until all of them have finished or ctx is done.
+// Coroutines that call coroutine.yield are resumed after the others that
+// are ready, those suspended by Await once their Future completes.
+//
+// The error of a coroutine ends it and is reported by Task.Result, Run
+// only returns ctx.Err(). It can be called again to continue.
+func (s *Scheduler) Run(ctx context.Context) error {
+	for {
+		s.mu.Lock()
+		s.ready = append(s.ready, s.completed...)
+		s.waiting -= len(s.completed)
+		s.completed = nil
+		s.mu.Unlock()
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if len(s.ready) == 0 {
+			if s.waiting == 0 {
+				return nil
+			}
+			select {
+			case <-s.wake:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			continue
+		}
+
+		t := s.ready[0]
+		s.ready = s.ready[1:]
+		s.step(t)
+	}
+}
+
+// Resumes t until it yields or ends
+func (s *Scheduler) step(t *Task) {
+	results, done, err := t.co.Resume(t.args...)
+	t.args = nil
+	if done || err != nil {
+		t.results, t.err, t.done = results, err, true
+		t.co.Close()
+		return
+	}
+
+	f := t.co.Future()
+	if f == nil {
+		s.ready = append(s.ready, t)
+		return
+	}
+	s.waiting++
+	go func() {
+		<-f.done
+		s.mu.Lock()
+		s.completed = append(s.completed, t)
+		s.mu.Unlock()
+		select {
+		case s.wake <- struct{}{}:
+		default:
+		}
+	}()
+}
+
+// Reports whether the coroutine has finished
+func (t *Task) Done() bool {
+	return t.done
+}
+
+// Returns the values returned by the coroutine, or the error that ended
+// it, once Done is true
+func (t *Task) Result() ([]interface{}, error) {
+	return t.results, t.err
+}
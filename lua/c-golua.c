@@ -7,11 +7,27 @@
 
 #define MT_GOFUNCTION "GoLua.GoFunction"
 #define MT_GOINTERFACE "GoLua.GoInterface"
+#define MT_GOTHREAD "GoLua.GoThread"
 
 #define GOLUA_DEFAULT_MSGHANDLER "golua_default_msghandler"
 
+/* returned by go callbacks when they have pushed an error message that must be raised */
+#define GOLUA_CALLBACK_ERROR (-2)
+
+/* returned by go functions that suspend the coroutine until a Future completes */
+#define GOLUA_CALLBACK_YIELD (-3)
+
+/* memory accounting of the states created by NewStateWithMemoryLimit,
+ * must match the definition in golua.h */
+typedef struct {
+	size_t used;
+	size_t peak;
+	size_t limit;
+} clua_memlimit;
+
 static const char GoStateRegistryKey = 'k'; //golua registry key
 static const char PanicFIDRegistryKey = 'k';
+static const char GoThreadsRegistryKey = 'k'; //threads of the state -> index of their go State
 
 
 /* taken from lua5.2 source */
@@ -59,14 +75,131 @@ unsigned int* clua_checkgosomething(lua_State* L, int index, const char *desired
 size_t clua_getgostate(lua_State* L)
 {
 	size_t gostateindex;
+	size_t *threadindex;
+	lua_checkstack(L, 4);
 	//get gostate from registry entry
 	lua_pushlightuserdata(L,(void*)&GoStateRegistryKey);
 	lua_gettable(L, LUA_REGISTRYINDEX);
 	gostateindex = (size_t)lua_touserdata(L,-1);
 	lua_pop(L,1);
+	if (lua_pushthread(L))
+	{
+		lua_pop(L,1);
+		return gostateindex;
+	}
+
+	/* coroutines have their own go State, created the first time they need it
+	 * and released by thread_gc once lua has collected the thread */
+	lua_pushlightuserdata(L,(void*)&GoThreadsRegistryKey);
+	lua_rawget(L, LUA_REGISTRYINDEX);
+	lua_pushvalue(L, -2);
+	lua_rawget(L, -2);
+	threadindex = (size_t*)lua_touserdata(L, -1);
+	if (threadindex == NULL)
+	{
+		lua_pop(L, 1);
+		threadindex = (size_t*)lua_newuserdata(L, sizeof(size_t));
+		*threadindex = golua_newthreadstate(gostateindex, L);
+		luaL_getmetatable(L, MT_GOTHREAD);
+		lua_setmetatable(L, -2);
+		// threads[thread] = threadindex
+		lua_pushvalue(L, -3);
+		lua_pushvalue(L, -2);
+		lua_rawset(L, -4);
+	}
+	gostateindex = *threadindex;
+	lua_pop(L, 3);
 	return gostateindex;
 }
 
+/* __gc of the values of the threads table */
+int thread_gc(lua_State *L)
+{
+	size_t *threadindex = (size_t*)lua_touserdata(L, 1);
+	golua_freethreadstate(*threadindex);
+	return 0;
+}
+
+/* coroutine.create and coroutine.wrap: calls the original function, its
+ * upvalue, and creates the go State of the new thread right away so that
+ * hooks installed after its creation reach it */
+static int coroutine_tracker(lua_State *L)
+{
+	luaL_checktype(L, 1, LUA_TFUNCTION);
+	lua_settop(L, 1);
+	lua_pushvalue(L, lua_upvalueindex(1));
+	lua_insert(L, 1);
+	lua_call(L, 1, 1);
+	if (lua_isthread(L, 1))
+	{
+		clua_getgostate(lua_tothread(L, 1));
+	}
+	else if (lua_getupvalue(L, 1, 1) != NULL)
+	{
+		// the function returned by wrap keeps the thread as its upvalue
+		if (lua_isthread(L, -1))
+			clua_getgostate(lua_tothread(L, -1));
+		lua_pop(L, 1);
+	}
+	return 1;
+}
+
+void clua_trackcoroutines(lua_State *L)
+{
+	static const char *const names[] = {"create", "wrap"};
+	int i;
+	lua_getglobal(L, "coroutine");
+	if (lua_istable(L, -1))
+	{
+		for (i = 0; i < 2; i++)
+		{
+			lua_getfield(L, -1, names[i]);
+			if (lua_isfunction(L, -1) && lua_tocfunction(L, -1) != &coroutine_tracker)
+			{
+				lua_pushcclosure(L, &coroutine_tracker, 1);
+				lua_setfield(L, -2, names[i]);
+			}
+			else
+			{
+				lua_pop(L, 1);
+			}
+		}
+	}
+	lua_pop(L, 1);
+}
+
+
+static int clua_callbackresult(lua_State *L, int r);
+
+/* called when a coroutine suspended by State.Await is resumed, returns the
+ * results of the Future or raises its error */
+#if LUA_VERSION_NUM == 502
+static int await_continuation(lua_State *L)
+#elif LUA_VERSION_NUM > 502
+static int await_continuation(lua_State *L, int status, lua_KContext ctx)
+#endif
+#if LUA_VERSION_NUM >= 502
+{
+	size_t gostateindex = clua_getgostate(L);
+	return clua_callbackresult(L, golua_awaitresult(gostateindex));
+}
+#endif
+
+/* go callbacks never let a go panic unwind through C, they push the error
+ * message and return GOLUA_CALLBACK_ERROR instead and the error is raised
+ * here, once no go frame is left on the C stack. Yields happen here too. */
+static int clua_callbackresult(lua_State *L, int r)
+{
+	if (r == GOLUA_CALLBACK_ERROR)
+		return lua_error(L);
+	if (r == GOLUA_CALLBACK_YIELD)
+#if LUA_VERSION_NUM >= 502
+		return lua_yieldk(L, 0, 0, &await_continuation);
+#else
+		return lua_yield(L, 0);
+#endif
+	return r;
+}
 
 //wrapper for callgofunction
 int callback_function(lua_State* L)
@@ -76,7 +209,8 @@ int callback_function(lua_State* L)
 	size_t gostateindex = clua_getgostate(L);
 	//remove the go function from the stack (to present same behavior as lua_CFunctions)
 	lua_remove(L,1);
-	return golua_callgofunction(gostateindex, fid!=NULL ? *fid : -1);
+	r = golua_callgofunction(gostateindex, fid!=NULL ? *fid : -1);
+	return clua_callbackresult(L, r);
 }
 
 //wrapper for gchook
@@ -114,7 +248,7 @@ static int callback_c (lua_State* L)
 {
 	int fid = clua_togofunction(L,lua_upvalueindex(1));
 	size_t gostateindex = clua_getgostate(L);
-	return golua_callgofunction(gostateindex,fid);
+	return clua_callbackresult(L, golua_callgofunction(gostateindex,fid));
 }
 
 int clua_upvalueindex(int n) 
@@ -127,6 +261,13 @@ void clua_pushcallback(lua_State* L)
 	lua_pushcclosure(L,callback_c,1);
 }
 
+/* tells whether the function at index is the C wrapper of a go function */
+int clua_isgocallback(lua_State *L, int index)
+{
+	lua_CFunction f = lua_tocfunction(L, index);
+	return f == &callback_function || f == &callback_c;
+}
+
 void clua_pushgostruct(lua_State* L, unsigned int iid)
 {
 	unsigned int* iidptr = (unsigned int *)lua_newuserdata(L, sizeof(unsigned int));
@@ -161,12 +302,10 @@ int interface_index_callback(lua_State *L)
 		return 1;
 	}
 
-	char *field_name = (char *)lua_tostring(L, 2);
-	if (field_name == NULL)
-	{
-		lua_pushnil(L);
-		return 1;
-	}
+	/* non string keys are read by go from the stack, index 2 must not be converted in place */
+	char *field_name = NULL;
+	if (lua_type(L, 2) == LUA_TSTRING)
+		field_name = (char *)lua_tostring(L, 2);
 
 	size_t gostateindex = clua_getgostate(L);
 
@@ -193,16 +332,38 @@ int interface_newindex_callback(lua_State *L)
 		return 1;
 	}
 
-	char *field_name = (char *)lua_tostring(L, 2);
-	if (field_name == NULL)
+	char *field_name = NULL;
+	if (lua_type(L, 2) == LUA_TSTRING)
+		field_name = (char *)lua_tostring(L, 2);
+
+	size_t gostateindex = clua_getgostate(L);
+
+	int r = golua_interface_newindex_callback(gostateindex, *iid, field_name);
+
+	if (r < 0)
 	{
-		lua_pushnil(L);
+		lua_error(L);
+		return 0;
+	}
+	else
+	{
+		return r;
+	}
+}
+
+/* called when lua code takes the length of a published go object */
+int interface_len_callback(lua_State *L)
+{
+	unsigned int *iid = clua_checkgosomething(L, 1, MT_GOINTERFACE);
+	if (iid == NULL)
+	{
+		lua_pushinteger(L, 0);
 		return 1;
 	}
 
 	size_t gostateindex = clua_getgostate(L);
 
-	int r = golua_interface_newindex_callback(gostateindex, *iid, field_name);
+	int r = golua_interface_len_callback(gostateindex, *iid);
 
 	if (r < 0)
 	{
@@ -215,28 +376,160 @@ int interface_newindex_callback(lua_State *L)
 	}
 }
 
+/* called by pairs and ipairs on a published go object */
+static int interface_pairs_common(lua_State *L, int ipairs)
+{
+	unsigned int *iid = clua_checkgosomething(L, 1, MT_GOINTERFACE);
+	if (iid == NULL)
+	{
+		return luaL_error(L, "attempt to iterate over an invalid go object");
+	}
+
+	size_t gostateindex = clua_getgostate(L);
+
+	int r = golua_interface_pairs_callback(gostateindex, *iid, ipairs);
+
+	if (r < 0)
+	{
+		lua_error(L);
+		return 0;
+	}
+	else
+	{
+		return r;
+	}
+}
+
+int interface_pairs_callback(lua_State *L)
+{
+	return interface_pairs_common(L, 0);
+}
+
+int interface_ipairs_callback(lua_State *L)
+{
+	return interface_pairs_common(L, 1);
+}
+
+/* message handler used by State.Call, lets go record the stack trace and
+ * returns the error value unchanged */
 int panic_msghandler(lua_State *L)
 {
 	size_t gostateindex = clua_getgostate(L);
 	go_panic_msghandler(gostateindex, (char *)lua_tolstring(L, -1, NULL));
-	return 0;
+	return 1;
+}
+
+/* pcall and xpcall replacing those of the base library: errors that must
+ * end the outermost call, the execution limit and the interruption of
+ * CallContext, are raised again instead of being caught (see
+ * golua_pcallerror). Since lua 5.2 the called function can yield, as with
+ * the original functions, through the continuations. */
+#if LUA_VERSION_NUM >= 502
+#define golua_pcallk(L, nargs, errfunc, depth, k) lua_pcallk(L, nargs, LUA_MULTRET, errfunc, depth, k)
+#else
+#define golua_pcallk(L, nargs, errfunc, depth, k) lua_pcall(L, nargs, LUA_MULTRET, errfunc)
+#endif
+
+/* returns the results of the call preceded by true, above the extra values
+ * at the bottom of the stack, or false and the error value */
+static int finish_pcall(lua_State *L, int status, int depth, int extra)
+{
+	if (status == 0 || status == LUA_YIELD)
+		return lua_gettop(L) - extra;
+	lua_checkstack(L, 2);
+	if (golua_pcallerror(clua_getgostate(L), depth) == GOLUA_CALLBACK_ERROR)
+		return lua_error(L);
+	lua_pushboolean(L, 0);
+	lua_pushvalue(L, -2);
+	return 2;
+}
+
+#if LUA_VERSION_NUM == 502
+static int pcall_continuation(lua_State *L)
+{
+	int ctx;
+	int status = lua_getctx(L, &ctx);
+	return finish_pcall(L, status, ctx, 0);
+}
+
+static int xpcall_continuation(lua_State *L)
+{
+	int ctx;
+	int status = lua_getctx(L, &ctx);
+	return finish_pcall(L, status, ctx, 2);
+}
+#elif LUA_VERSION_NUM > 502
+static int pcall_continuation(lua_State *L, int status, lua_KContext ctx)
+{
+	return finish_pcall(L, status, (int)ctx, 0);
+}
+
+static int xpcall_continuation(lua_State *L, int status, lua_KContext ctx)
+{
+	return finish_pcall(L, status, (int)ctx, 2);
 }
+#endif
 
+/* pcall(f, ...) */
+static int safe_pcall(lua_State *L)
+{
+	int depth, status;
+	luaL_checkany(L, 1);
+	depth = (int)golua_pcallbegin(clua_getgostate(L));
+	lua_pushboolean(L, 1);
+	lua_insert(L, 1);
+	status = golua_pcallk(L, lua_gettop(L) - 2, 0, depth, &pcall_continuation);
+	return finish_pcall(L, status, depth, 0);
+}
+
+/* xpcall(f, msgh, ...), the arguments after msgh are passed to f in every
+ * lua version */
+static int safe_xpcall(lua_State *L)
+{
+	int depth, status;
+	int n = lua_gettop(L);
+	luaL_checkany(L, 2);
+	depth = (int)golua_pcallbegin(clua_getgostate(L));
+	// f, msgh, true, f, args...
+	lua_pushboolean(L, 1);
+	lua_pushvalue(L, 1);
+	lua_insert(L, 3);
+	lua_insert(L, 3);
+	status = golua_pcallk(L, n - 2, 2, depth, &xpcall_continuation);
+	return finish_pcall(L, status, depth, 2);
+}
+
+/* renames pcall and xpcall to unsafe_pcall and unsafe_xpcall, and replaces
+ * them with safe_pcall and safe_xpcall */
 void clua_hide_pcall(lua_State *L)
 {
 	lua_getglobal(L, "pcall");
 	lua_setglobal(L, "unsafe_pcall");
-	lua_pushnil(L);
-	lua_setglobal(L, "pcall");
+	lua_register(L, "pcall", &safe_pcall);
 
 	lua_getglobal(L, "xpcall");
 	lua_setglobal(L, "unsafe_xpcall");
-	lua_pushnil(L);
-	lua_setglobal(L, "xpcall");
+	lua_register(L, "xpcall", &safe_xpcall);
 }
 
 void clua_initstate(lua_State* L)
 {
+	/* create the table of the go States of the threads, with weak keys */
+	lua_pushlightuserdata(L, (void*)&GoThreadsRegistryKey);
+	lua_newtable(L);
+	lua_newtable(L);
+	lua_pushliteral(L, "__mode");
+	lua_pushliteral(L, "k");
+	lua_settable(L, -3);
+	lua_setmetatable(L, -2);
+	lua_settable(L, LUA_REGISTRYINDEX);
+
+	luaL_newmetatable(L, MT_GOTHREAD);
+	lua_pushliteral(L, "__gc");
+	lua_pushcfunction(L, &thread_gc);
+	lua_settable(L, -3);
+	lua_pop(L, 1);
+
 	/* create the GoLua.GoFunction metatable */
 	luaL_newmetatable(L, MT_GOFUNCTION);
 
@@ -268,8 +561,26 @@ void clua_initstate(lua_State* L)
 	lua_pushcfunction(L, &interface_newindex_callback);
 	lua_settable(L, -3);
 
-	lua_register(L, GOLUA_DEFAULT_MSGHANDLER, &panic_msghandler);
+	// gointerface_metatable[__len] = &interface_len_callback
+	lua_pushliteral(L, "__len");
+	lua_pushcfunction(L, &interface_len_callback);
+	lua_settable(L, -3);
+
+	// gointerface_metatable[__pairs] = &interface_pairs_callback
+	lua_pushliteral(L, "__pairs");
+	lua_pushcfunction(L, &interface_pairs_callback);
+	lua_settable(L, -3);
+
+	// gointerface_metatable[__ipairs] = &interface_ipairs_callback
+	lua_pushliteral(L, "__ipairs");
+	lua_pushcfunction(L, &interface_ipairs_callback);
+	lua_settable(L, -3);
+
 	lua_pop(L, 1);
+
+	/* kept in the registry, where scripts can neither remove nor replace it */
+	lua_pushcfunction(L, &panic_msghandler);
+	lua_setfield(L, LUA_REGISTRYINDEX, GOLUA_DEFAULT_MSGHANDLER);
 }
 
 
@@ -336,24 +647,62 @@ void clua_setallocf(lua_State* L, void* goallocf)
 	lua_setallocf(L,&allocwrapper,goallocf);
 }
 
+/* allocator of NewStateWithMemoryLimit, refuses to grow the memory in use
+ * past the limit (0 means no limit), lua then raises a memory error.
+ * Shrinking blocks never fails, as lua requires. */
+static void* memlimit_alloc(void* ud, void* ptr, size_t osize, size_t nsize)
+{
+	clua_memlimit* m = (clua_memlimit*)ud;
+	void* p;
+	if (ptr == NULL)
+		osize = 0; /* lua 5.2+ pass the type of the new object there */
+	if (nsize == 0)
+	{
+		free(ptr);
+		m->used -= osize;
+		return NULL;
+	}
+	if (m->limit > 0 && nsize > osize && m->used - osize + nsize > m->limit)
+		return NULL;
+	p = realloc(ptr, nsize);
+	if (p == NULL)
+		return NULL;
+	m->used = m->used - osize + nsize;
+	if (m->used > m->peak)
+		m->peak = m->used;
+	return p;
+}
+
+lua_State* clua_newstate_memlimit(clua_memlimit* m)
+{
+	return lua_newstate(&memlimit_alloc, m);
+}
+
 void clua_openbase(lua_State* L)
 {
 	lua_pushcfunction(L,&luaopen_base);
 	lua_pushstring(L,"");
 	lua_call(L, 1, 0);
 	clua_hide_pcall(L);
+	clua_trackcoroutines(L);
 }
 
 void clua_hook_function(lua_State *L, lua_Debug *ar)
 {
 	lua_checkstack(L, 2);
 	size_t gostateindex = clua_getgostate(L);
-	golua_callgohook(gostateindex);
+	if (golua_callgohook(gostateindex, ar) == GOLUA_CALLBACK_ERROR)
+		lua_error(L);
+}
+
+void clua_sethook(lua_State* L, int mask, int n)
+{
+	lua_sethook(L, &clua_hook_function, mask, n);
 }
 
-void clua_sethook(lua_State* L, int n)
+void clua_unsethook(lua_State* L)
 {
-	lua_sethook(L, &clua_hook_function, LUA_MASKCOUNT, n);
+	lua_sethook(L, NULL, 0, 0);
 }
 
 
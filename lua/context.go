@@ -0,0 +1,63 @@
+package lua
+
+import (
+	"context"
+)
+
+// Like Call but aborts the lua code it runs as soon as ctx is done, the
+// returned error then wraps ctx.Err() so that errors.Is(err,
+// context.Canceled) or errors.Is(err, context.DeadlineExceeded) hold.
+//
+// The check happens in a lua hook, a go function or a long running C
+// function called by the script is not interrupted until it returns.
+// A hook installed with SetHook or SetExecutionLimit is suspended once
+// the context is done and installed again when CallContext returns.
+func (L *State) CallContext(ctx context.Context, nargs, nresults int) (err error) {
+	if ctx.Done() == nil {
+		// ctx can never be done
+		return L.Call(nargs, nresults)
+	}
+
+	stop := make(chan struct{})
+	if err := ctx.Err(); err != nil {
+		L.interrupt(stop, err)
+	}
+
+	watcher := make(chan struct{})
+	go func() {
+		defer close(watcher)
+		select {
+		case <-ctx.Done():
+			L.interrupt(stop, ctx.Err())
+		case <-stop:
+		}
+	}()
+
+	defer func() {
+		close(stop)
+		<-watcher
+		cause := L.clearInterrupt(stop)
+		if le, ok := err.(*LuaError); ok && cause != nil && le.cause == nil {
+			// raised again with another message, by coroutine.wrap for
+			// instance, which adds the position of its caller
+			le.cause = cause
+		}
+	}()
+	return L.Call(nargs, nresults)
+}
+
+// Like DoString but aborts the execution when ctx is done, see CallContext
+func (L *State) DoStringContext(ctx context.Context, str string) error {
+	if r := L.LoadString(str); r != 0 {
+		return L.LoadError(r)
+	}
+	return L.CallContext(ctx, 0, LUA_MULTRET)
+}
+
+// Like DoFile but aborts the execution when ctx is done, see CallContext
+func (L *State) DoFileContext(ctx context.Context, filename string) error {
+	if r := L.LoadFile(filename); r != 0 {
+		return L.LoadError(r)
+	}
+	return L.CallContext(ctx, 0, LUA_MULTRET)
+}
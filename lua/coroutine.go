@@ -0,0 +1,173 @@
+package lua
+
+/*
+#include <lua.h>
+#include <stdlib.h>
+#include "golua.h"
+*/
+import "C"
+
+import (
+	"errors"
+)
+
+// Status of a coroutine, as returned by coroutine.status
+type CoroutineStatus int
+
+const (
+	// Created or yielded, Resume can be called
+	CoroutineSuspended CoroutineStatus = iota
+	// Running the go function that asks for the status
+	CoroutineRunning
+	// Active but not running, it resumed another coroutine
+	CoroutineNormal
+	// Finished or stopped by an error
+	CoroutineDead
+)
+
+func (s CoroutineStatus) String() string {
+	switch s {
+	case CoroutineSuspended:
+		return "suspended"
+	case CoroutineRunning:
+		return "running"
+	case CoroutineNormal:
+		return "normal"
+	}
+	return "dead"
+}
+
+// Returned by Coroutine.Resume for coroutines that can't be resumed
+var (
+	ErrCoroutineDead   = errors.New("lua: cannot resume dead coroutine")
+	ErrCoroutineActive = errors.New("lua: cannot resume non-suspended coroutine")
+)
+
+// A lua coroutine driven from go, see NewCoroutine
+type Coroutine struct {
+	thread *State
+	ref    int
+}
+
+// Creates a coroutine running the function on top of the stack, which is
+// popped. The coroutine shares the globals and the go registry of L, go
+// functions called by it receive the State returned by Thread.
+//
+// The coroutine is kept alive until Close is called.
+func (L *State) NewCoroutine() (*Coroutine, error) {
+	if !L.IsFunction(-1) {
+		return nil, errors.New("lua: the body of a coroutine must be a function")
+	}
+	T := L.NewThread()
+	L.PushValue(-2)
+	XMove(L, T, 1)
+	ref := L.Ref(LUA_REGISTRYINDEX)
+	L.Pop(1)
+	return &Coroutine{thread: T, ref: ref}, nil
+}
+
+// Returns the State of the thread running the coroutine
+func (co *Coroutine) Thread() *State {
+	return co.thread
+}
+
+// Starts or continues the execution of the coroutine, args are passed to
+// the body of the coroutine the first time and returned by
+// coroutine.yield afterwards. They are converted with PushGoValue.
+//
+// Returns the values passed to coroutine.yield, or returned by the body
+// with done set once it has finished, converted to nil, bool, int64,
+// float64, string, tables (see ToValue) or the objects pushed with
+// PushGoStruct. A lua error ends the coroutine and is returned as a
+// *LuaError with the stack trace of the coroutine.
+//
+// A coroutine suspended by Await is resumed once its Future completes, args
+// are then ignored.
+func (co *Coroutine) Resume(args ...interface{}) (results []interface{}, done bool, err error) {
+	T := co.thread
+	switch co.Status() {
+	case CoroutineDead:
+		return nil, true, ErrCoroutineDead
+	case CoroutineRunning, CoroutineNormal:
+		return nil, false, ErrCoroutineActive
+	}
+
+	nargs := 0
+	if f := co.Future(); f != nil {
+		if !yieldContinuations {
+			// the results of the future are those of the go function
+			T.awaiting = nil
+			if nargs, err = T.pushFutureResults(f); err != nil {
+				T.PushNil()
+				T.PushString(err.Error())
+				nargs = 2
+			}
+		}
+	} else {
+		if !T.CheckStack(len(args)) {
+			return nil, false, errors.New("lua: too many arguments to resume")
+		}
+		for i, arg := range args {
+			if err := T.PushGoValue(arg); err != nil {
+				T.Pop(i)
+				return nil, false, err
+			}
+		}
+		nargs = len(args)
+	}
+
+	T.enterCall()
+	defer T.exitCall()
+	r, nres := T.resume(nargs)
+	if r != 0 && r != LUA_YIELD {
+		err := T.callError(r)
+		T.SetTop(0)
+		return nil, true, err
+	}
+
+	results, err = T.decodeResults(T.GetTop() - nres + 1)
+	T.SetTop(0)
+	return results, r == 0, err
+}
+
+// Returns the Future the coroutine waits for, nil unless it is suspended
+// by Await
+func (co *Coroutine) Future() *Future {
+	T := co.thread
+	if T.awaiting == nil || T.Status() != LUA_YIELD {
+		return nil
+	}
+	return T.awaiting
+}
+
+// Returns the status of the coroutine
+func (co *Coroutine) Status() CoroutineStatus {
+	T := co.thread
+	if T.running == T {
+		return CoroutineRunning
+	}
+	switch T.Status() {
+	case LUA_YIELD:
+		return CoroutineSuspended
+	case 0:
+		var ar C.lua_Debug
+		if C.lua_getstack(T.s, 0, &ar) > 0 {
+			return CoroutineNormal
+		}
+		if T.GetTop() > 0 {
+			// the body hasn't started yet
+			return CoroutineSuspended
+		}
+	}
+	return CoroutineDead
+}
+
+// Releases the coroutine, lua collects it once it is no longer
+// referenced by lua values. The Coroutine and its State can't be used
+// afterwards.
+func (co *Coroutine) Close() {
+	if co.ref != LUA_NOREF {
+		co.thread.main.Unref(LUA_REGISTRYINDEX, co.ref)
+		co.ref = LUA_NOREF
+	}
+}
@@ -0,0 +1,304 @@
+package lua
+
+//#include <lua.h>
+//#include <stdlib.h>
+//#include "golua.h"
+import "C"
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Line coverage of lua chunks, collected from one or more states with
+// StartCoverage. A Coverage can be shared by states running in different
+// goroutines.
+//
+// Lines are known to be executable once the function containing them has
+// been called, lines of functions that never ran are not reported and
+// don't count in Percent: a chunk defining a function that is never
+// called can still be 100% covered.
+type Coverage struct {
+	mu    sync.Mutex
+	files map[string]map[int]int64
+	// functions whose lines have been added, by chunk and first line
+	functions map[string]map[int]bool
+}
+
+// Returns an empty Coverage
+func NewCoverage() *Coverage {
+	return &Coverage{
+		files:     make(map[string]map[int]int64),
+		functions: make(map[string]map[int]bool),
+	}
+}
+
+// lua_getinfo options of the coverage hook, allocated once as the hook
+// runs at every line
+var (
+	coverageSourceInfo = C.CString("S")
+	coverageLinesInfo  = C.CString("SL")
+)
+
+// Starts recording in c the lines executed by L, replacing the Coverage
+// set by a previous call
+func (L *State) StartCoverage(c *Coverage) {
+	L.StopCoverage()
+	L.coverageHook = L.addHook(&hook{mask: LUA_MASKCALL | LUA_MASKLINE, rawFn: func(L *State, ar *C.lua_Debug) {
+		switch event := ar.event; {
+		case event == LUA_HOOKLINE:
+			C.lua_getinfo(L.s, coverageSourceInfo, ar)
+			c.hit(chunkName(ar), int(ar.currentline))
+		case event == LUA_HOOKCALL || event == hookTailCallEvent:
+			C.lua_getinfo(L.s, coverageSourceInfo, ar)
+			if ar.what == nil || C.GoString(ar.what) == "C" {
+				return
+			}
+			chunk := chunkName(ar)
+			if c.seen(chunk, int(ar.linedefined)) {
+				return
+			}
+			// the table of the lines of the function, a key and a value
+			if !L.CheckStack(3) {
+				return
+			}
+			C.lua_getinfo(L.s, coverageLinesInfo, ar)
+			c.addLines(chunk, L.tableKeys(-1))
+			L.Pop(1)
+		}
+	}})
+}
+
+// Stops the recording started by StartCoverage
+func (L *State) StopCoverage() {
+	if L.coverageHook != 0 {
+		L.RemoveHook(L.coverageHook)
+		L.coverageHook = 0
+	}
+}
+
+// Name of the chunk of the function described by ar after lua_getinfo
+// with "S": the file name for files, the short source for strings
+func chunkName(ar *C.lua_Debug) string {
+	source := C.GoString(ar.source)
+	if strings.HasPrefix(source, "@") || strings.HasPrefix(source, "=") {
+		return source[1:]
+	}
+	return C.GoString(&ar.short_src[0])
+}
+
+// Returns the integer keys of the table at index
+func (L *State) tableKeys(index int) []int {
+	index = L.absIndex(index)
+	var keys []int
+	L.PushNil()
+	for L.Next(index) != 0 {
+		keys = append(keys, L.ToInteger(-2))
+		L.Pop(1)
+	}
+	return keys
+}
+
+func (c *Coverage) file(chunk string) map[int]int64 {
+	f, ok := c.files[chunk]
+	if !ok {
+		f = make(map[int]int64)
+		c.files[chunk] = f
+	}
+	return f
+}
+
+func (c *Coverage) hit(chunk string, line int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.file(chunk)[line]++
+}
+
+// Records that the function of chunk starting at line has been called,
+// reports whether it was already known
+func (c *Coverage) seen(chunk string, line int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fs, ok := c.functions[chunk]
+	if !ok {
+		fs = make(map[int]bool)
+		c.functions[chunk] = fs
+	}
+	if fs[line] {
+		return true
+	}
+	fs[line] = true
+	return false
+}
+
+func (c *Coverage) addLines(chunk string, lines []int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f := c.file(chunk)
+	for _, l := range lines {
+		if _, ok := f[l]; !ok {
+			f[l] = 0
+		}
+	}
+}
+
+// Adds the coverage recorded in other to c
+func (c *Coverage) Merge(other *Coverage) {
+	other.mu.Lock()
+	defer other.mu.Unlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for chunk, lines := range other.files {
+		f := c.file(chunk)
+		for l, n := range lines {
+			f[l] += n
+		}
+	}
+	for chunk, fs := range other.functions {
+		if c.functions[chunk] == nil {
+			c.functions[chunk] = make(map[int]bool)
+		}
+		for l := range fs {
+			c.functions[chunk][l] = true
+		}
+	}
+}
+
+// Returns the names of the chunks with recorded lines, sorted
+func (c *Coverage) Chunks() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	chunks := make([]string, 0, len(c.files))
+	for chunk := range c.files {
+		chunks = append(chunks, chunk)
+	}
+	sort.Strings(chunks)
+	return chunks
+}
+
+// Returns the number of times each known line of chunk was executed, 0
+// for lines that didn't run
+func (c *Coverage) Lines(chunk string) map[int]int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	lines := make(map[int]int64, len(c.files[chunk]))
+	for l, n := range c.files[chunk] {
+		lines[l] = n
+	}
+	return lines
+}
+
+// Returns the percentage of known lines that were executed, over all the
+// chunks, 100 if no line is known. The lines of the functions that were
+// never called are unknown.
+func (c *Coverage) Percent() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	hit, total := 0, 0
+	for _, lines := range c.files {
+		h, t := countHits(lines)
+		hit += h
+		total += t
+	}
+	return percent(hit, total)
+}
+
+func countHits(lines map[int]int64) (hit, total int) {
+	for _, n := range lines {
+		if n > 0 {
+			hit++
+		}
+	}
+	return hit, len(lines)
+}
+
+func percent(hit, total int) float64 {
+	if total == 0 {
+		return 100
+	}
+	return 100 * float64(hit) / float64(total)
+}
+
+func sortedLines(lines map[int]int64) []int {
+	ls := make([]int, 0, len(lines))
+	for l := range lines {
+		ls = append(ls, l)
+	}
+	sort.Ints(ls)
+	return ls
+}
+
+// Writes the coverage in the LCOV tracefile format, as read by genhtml
+// and most coverage services
+func (c *Coverage) WriteLCOV(w io.Writer) error {
+	for _, chunk := range c.Chunks() {
+		lines := c.Lines(chunk)
+		var b strings.Builder
+		fmt.Fprintf(&b, "TN:\nSF:%s\n", chunk)
+		for _, l := range sortedLines(lines) {
+			fmt.Fprintf(&b, "DA:%d,%d\n", l, lines[l])
+		}
+		hit, total := countHits(lines)
+		fmt.Fprintf(&b, "LF:%d\nLH:%d\nend_of_record\n", total, hit)
+		if _, err := io.WriteString(w, b.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Writes a text report with the coverage of every chunk and the lines
+// that didn't run:
+//
+//	rules.lua   80.0% (8/10)   missed: 4, 12-13
+//	total       80.0% (8/10)
+func (c *Coverage) WriteText(w io.Writer) error {
+	var b strings.Builder
+	thit, ttotal := 0, 0
+	for _, chunk := range c.Chunks() {
+		lines := c.Lines(chunk)
+		hit, total := countHits(lines)
+		thit += hit
+		ttotal += total
+		fmt.Fprintf(&b, "%s\t%.1f%% (%d/%d)", chunk, percent(hit, total), hit, total)
+		if missed := missedRanges(lines); missed != "" {
+			fmt.Fprintf(&b, "\tmissed: %s", missed)
+		}
+		b.WriteString("\n")
+	}
+	fmt.Fprintf(&b, "total\t%.1f%% (%d/%d)\n", percent(thit, ttotal), thit, ttotal)
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// Formats the lines that didn't run as a list of ranges: "4, 12-13"
+func missedRanges(lines map[int]int64) string {
+	var ranges []string
+	start, prev := -1, -1
+	flush := func() {
+		if start < 0 {
+			return
+		}
+		if start == prev {
+			ranges = append(ranges, fmt.Sprint(start))
+		} else {
+			ranges = append(ranges, fmt.Sprintf("%d-%d", start, prev))
+		}
+	}
+	for _, l := range sortedLines(lines) {
+		if lines[l] > 0 {
+			continue
+		}
+		if start >= 0 && l == prev+1 {
+			prev = l
+			continue
+		}
+		flush()
+		start, prev = l, l
+	}
+	flush()
+	return strings.Join(ranges, ", ")
+}
@@ -0,0 +1,321 @@
+package lua
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The only thread reported to DAP clients
+const dapThreadID = 1
+
+// Serves the Debug Adapter Protocol for d on l, one client at a time,
+// until l is closed. Editors such as VS Code can then attach to the
+// running State, for instance with a launch configuration of type "lua"
+// and "debugServer" set to the port of l:
+//
+//	l, err := net.Listen("tcp", "127.0.0.1:4711")
+//	…
+//	go d.ServeDAP(l)
+//
+// When a client disconnects its breakpoints are removed and the execution
+// is resumed.
+func (d *Debugger) ServeDAP(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		s := &dapSession{d: d, conn: conn, r: bufio.NewReader(conn)}
+		s.serve()
+	}
+}
+
+// Listens on the TCP address addr, "127.0.0.1:0" picks a free port, and
+// serves the Debug Adapter Protocol for d in the background, see ServeDAP
+func (d *Debugger) ListenDAP(addr string) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	go d.ServeDAP(l)
+	return l, nil
+}
+
+type dapSession struct {
+	d    *Debugger
+	conn net.Conn
+	r    *bufio.Reader
+
+	mu      sync.Mutex
+	seq     int
+	sources map[string]bool
+}
+
+type dapRequest struct {
+	Seq       int             `json:"seq"`
+	Type      string          `json:"type"`
+	Command   string          `json:"command"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+type dapSource struct {
+	Name string `json:"name,omitempty"`
+	Path string `json:"path,omitempty"`
+}
+
+func (s *dapSession) serve() {
+	defer s.conn.Close()
+	s.sources = make(map[string]bool)
+	s.d.setStopHandler(func(reason string) {
+		s.event("stopped", map[string]interface{}{
+			"reason":            reason,
+			"threadId":          dapThreadID,
+			"allThreadsStopped": true,
+		})
+	})
+	defer s.detach()
+
+	for {
+		req, err := s.read()
+		if err != nil {
+			return
+		}
+		if req.Type != "request" {
+			continue
+		}
+		body, err := s.handle(req)
+		s.respond(req, body, err)
+		switch req.Command {
+		case "initialize":
+			s.event("initialized", nil)
+		case "disconnect":
+			return
+		}
+	}
+}
+
+// Forgets the breakpoints of the client and lets the lua code run
+func (s *dapSession) detach() {
+	s.d.setStopHandler(nil)
+	for source := range s.sources {
+		s.d.SetBreakpoints(source, nil)
+	}
+	s.d.Continue()
+}
+
+// Reads a message: a Content-Length header, an empty line and the JSON body
+func (s *dapSession) read() (*dapRequest, error) {
+	header, err := textproto.NewReader(s.r).ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(header.Get("Content-Length"))
+	if err != nil {
+		return nil, fmt.Errorf("lua: bad DAP header: %v", err)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(s.r, data); err != nil {
+		return nil, err
+	}
+	req := &dapRequest{}
+	if err := json.Unmarshal(data, req); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+func (s *dapSession) send(msg map[string]interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seq++
+	msg["seq"] = s.seq
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(s.conn, "Content-Length: %d\r\n\r\n%s", len(data), data)
+}
+
+func (s *dapSession) respond(req *dapRequest, body interface{}, err error) {
+	msg := map[string]interface{}{
+		"type":        "response",
+		"request_seq": req.Seq,
+		"command":     req.Command,
+		"success":     err == nil,
+	}
+	if err != nil {
+		msg["message"] = err.Error()
+	}
+	if body != nil {
+		msg["body"] = body
+	}
+	s.send(msg)
+}
+
+func (s *dapSession) event(event string, body interface{}) {
+	msg := map[string]interface{}{"type": "event", "event": event}
+	if body != nil {
+		msg["body"] = body
+	}
+	s.send(msg)
+}
+
+func (s *dapSession) handle(req *dapRequest) (interface{}, error) {
+	var args struct {
+		Source      dapSource `json:"source"`
+		Breakpoints []struct {
+			Line int `json:"line"`
+		} `json:"breakpoints"`
+		Lines              []int  `json:"lines"`
+		FrameID            int    `json:"frameId"`
+		VariablesReference int    `json:"variablesReference"`
+		Expression         string `json:"expression"`
+	}
+	if len(req.Arguments) > 0 {
+		if err := json.Unmarshal(req.Arguments, &args); err != nil {
+			return nil, err
+		}
+	}
+
+	switch req.Command {
+	case "initialize":
+		return map[string]interface{}{
+			"supportsConfigurationDoneRequest": true,
+			"supportsEvaluateForHovers":        true,
+		}, nil
+
+	case "launch", "attach", "configurationDone", "setExceptionBreakpoints", "disconnect":
+		return nil, nil
+
+	case "setBreakpoints":
+		source := args.Source.Path
+		if source == "" {
+			source = args.Source.Name
+		}
+		lines := args.Lines
+		if args.Breakpoints != nil {
+			lines = lines[:0]
+			for _, b := range args.Breakpoints {
+				lines = append(lines, b.Line)
+			}
+		}
+		s.d.SetBreakpoints(source, lines)
+		s.sources[filepath.Clean(source)] = true
+		bps := make([]map[string]interface{}, len(lines))
+		for i, l := range lines {
+			bps[i] = map[string]interface{}{"verified": true, "line": l}
+		}
+		return map[string]interface{}{"breakpoints": bps}, nil
+
+	case "threads":
+		return map[string]interface{}{
+			"threads": []map[string]interface{}{{"id": dapThreadID, "name": "lua"}},
+		}, nil
+
+	case "stackTrace":
+		st, err := s.d.StackTrace()
+		if err != nil {
+			return nil, err
+		}
+		frames := make([]map[string]interface{}, len(st))
+		for i, e := range st {
+			frames[i] = dapFrame(i, e)
+		}
+		return map[string]interface{}{"stackFrames": frames, "totalFrames": len(frames)}, nil
+
+	case "scopes":
+		scopes, err := s.d.Scopes(args.FrameID - 1)
+		if err != nil {
+			return nil, err
+		}
+		res := make([]map[string]interface{}, len(scopes))
+		for i, sc := range scopes {
+			res[i] = map[string]interface{}{
+				"name":               sc.Name,
+				"variablesReference": sc.Reference,
+				"expensive":          sc.Name == "Globals",
+			}
+		}
+		return map[string]interface{}{"scopes": res}, nil
+
+	case "variables":
+		vars, err := s.d.Variables(args.VariablesReference)
+		if err != nil {
+			return nil, err
+		}
+		res := make([]map[string]interface{}, len(vars))
+		for i, v := range vars {
+			res[i] = map[string]interface{}{
+				"name":               v.Name,
+				"value":              v.Value,
+				"type":               v.Type,
+				"variablesReference": v.Reference,
+			}
+		}
+		return map[string]interface{}{"variables": res}, nil
+
+	case "evaluate":
+		level := 0
+		if args.FrameID > 0 {
+			level = args.FrameID - 1
+		}
+		v, err := s.d.Evaluate(level, args.Expression)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{
+			"result":             v.Value,
+			"type":               v.Type,
+			"variablesReference": v.Reference,
+		}, nil
+
+	case "continue":
+		s.d.Continue()
+		return map[string]interface{}{"allThreadsContinued": true}, nil
+	case "next":
+		s.d.StepOver()
+		return nil, nil
+	case "stepIn":
+		s.d.StepIn()
+		return nil, nil
+	case "stepOut":
+		s.d.StepOut()
+		return nil, nil
+	case "pause":
+		s.d.Pause()
+		return nil, nil
+	}
+	return nil, errors.New("unsupported request " + req.Command)
+}
+
+// Describes the stack frame at level for the stackTrace request
+func dapFrame(level int, e LuaStackEntry) map[string]interface{} {
+	frame := map[string]interface{}{
+		"id":     level + 1,
+		"name":   profileFunctionName(e),
+		"line":   e.CurrentLine,
+		"column": 1,
+	}
+	switch {
+	case e.What == "C" || e.What == "Go":
+		frame["presentationHint"] = "subtle"
+	case strings.HasPrefix(e.Source, "@"):
+		path := e.Source[1:]
+		if abs, err := filepath.Abs(path); err == nil {
+			path = abs
+		}
+		frame["source"] = dapSource{Name: filepath.Base(path), Path: path}
+	default:
+		frame["source"] = dapSource{Name: e.ShortSource}
+	}
+	return frame
+}
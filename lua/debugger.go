@@ -0,0 +1,522 @@
+package lua
+
+//#include <lua.h>
+//#include <stdlib.h>
+//#include "golua.h"
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Returned by the inspection methods of Debugger when the lua code isn't
+// stopped
+var ErrNotStopped = errors.New("lua: debugger not stopped")
+
+// Maximum number of fields of a table listed by Debugger.Variables
+const debugMaxChildren = 1000
+
+type debugMode int
+
+const (
+	debugRun debugMode = iota
+	debugPause
+	debugStepIn
+	debugStepOver
+	debugStepOut
+)
+
+// A variable shown by the debugger
+type DebugVariable struct {
+	Name  string
+	Type  string
+	Value string
+	// Non-zero for tables, their fields are listed by Variables
+	Reference int
+}
+
+// A group of variables of a stack frame
+type DebugScope struct {
+	Name      string
+	Reference int
+}
+
+const (
+	debugRefLocals = iota
+	debugRefUpvalues
+	debugRefGlobals
+	debugRefValue
+)
+
+// What a variable reference stands for, references are only valid until
+// the execution resumes
+type debugRef struct {
+	kind  int
+	level int
+	// registry reference of the table, for debugRefValue
+	ref int
+}
+
+// Interactive debugger for the lua code run by a State, built on a line
+// hook. When the execution stops at a breakpoint, at the end of a step or
+// after Pause, the goroutine running the lua code blocks inside the hook
+// until Continue or one of the step methods is called from another
+// goroutine. While stopped the stack, the variables and expressions can be
+// inspected from other goroutines: the inspection runs on the stopped
+// goroutine, the State is never used concurrently.
+//
+// ServeDAP exposes a Debugger to editors through the Debug Adapter
+// Protocol.
+type Debugger struct {
+	L      *State
+	hookID HookID
+
+	// serializes the commands that hand work to the stopped goroutine
+	ctl sync.Mutex
+
+	mu          sync.Mutex
+	breakpoints map[int][]string
+	mode        debugMode
+	stepDepth   int
+	stopped     bool
+	stopDepth   int
+	onStop      func(reason string)
+	// thread that stopped, and the one a step over or out started in
+	stopThread *State
+	stepThread *State
+
+	work   chan func()
+	resume chan struct{}
+
+	// only used by the stopped goroutine
+	refs []debugRef
+}
+
+// Attaches a debugger to L, must be called while no lua code is running
+// on L
+func NewDebugger(L *State) *Debugger {
+	d := &Debugger{
+		L:           L,
+		breakpoints: make(map[int][]string),
+		work:        make(chan func()),
+		resume:      make(chan struct{}),
+	}
+	d.hookID = L.addHook(&hook{mask: LUA_MASKLINE, rawFn: d.lineHook})
+	return d
+}
+
+// Detaches the debugger from its State, must be called while no lua code
+// is running on it
+func (d *Debugger) Close() {
+	d.L.RemoveHook(d.hookID)
+}
+
+// Replaces the breakpoints of source, a file name or the name of a chunk
+// (as given to Load without the leading '@' or '='). A file name matches
+// the chunks whose name is the same file or a relative path it ends with.
+func (d *Debugger) SetBreakpoints(source string, lines []int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	source = filepath.Clean(source)
+	for line, sources := range d.breakpoints {
+		kept := sources[:0]
+		for _, s := range sources {
+			if s != source {
+				kept = append(kept, s)
+			}
+		}
+		if len(kept) == 0 {
+			delete(d.breakpoints, line)
+		} else {
+			d.breakpoints[line] = kept
+		}
+	}
+	for _, line := range lines {
+		d.breakpoints[line] = append(d.breakpoints[line], source)
+	}
+}
+
+// Removes every breakpoint
+func (d *Debugger) ClearBreakpoints() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.breakpoints = make(map[int][]string)
+}
+
+// Stops the execution at the next line
+func (d *Debugger) Pause() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.stopped {
+		d.mode = debugPause
+	}
+}
+
+// Resumes the execution until the next breakpoint
+func (d *Debugger) Continue() { d.resumeAs(debugRun) }
+
+// Resumes the execution until the next line, entering function calls
+func (d *Debugger) StepIn() { d.resumeAs(debugStepIn) }
+
+// Resumes the execution until the next line of the current function or
+// of one of its callers, in the same coroutine
+func (d *Debugger) StepOver() { d.resumeAs(debugStepOver) }
+
+// Resumes the execution until the current function returns to a lua
+// caller, in the same coroutine
+func (d *Debugger) StepOut() { d.resumeAs(debugStepOut) }
+
+func (d *Debugger) resumeAs(mode debugMode) {
+	d.ctl.Lock()
+	defer d.ctl.Unlock()
+	d.mu.Lock()
+	d.mode = mode
+	d.stepDepth = d.stopDepth
+	d.stepThread = d.stopThread
+	stopped := d.stopped
+	d.stopped = false
+	d.mu.Unlock()
+	if stopped {
+		d.resume <- struct{}{}
+	}
+}
+
+// Reports whether the execution is stopped
+func (d *Debugger) Stopped() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.stopped
+}
+
+// Sets the function called, on the goroutine running the lua code, every
+// time the execution stops. reason is "breakpoint", "step" or "pause".
+func (d *Debugger) setStopHandler(f func(reason string)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.onStop = f
+}
+
+func (d *Debugger) lineHook(L *State, ar *C.lua_Debug) {
+	d.mu.Lock()
+	mode, stepDepth, stepThread := d.mode, d.stepDepth, d.stepThread
+	sources := d.breakpoints[int(ar.currentline)]
+	d.mu.Unlock()
+
+	switch mode {
+	case debugPause:
+		d.stop(L, "pause")
+		return
+	case debugStepIn:
+		d.stop(L, "step")
+		return
+	case debugStepOver:
+		// depths of different coroutines can't be compared
+		if L == stepThread && L.stackDepth() <= stepDepth {
+			d.stop(L, "step")
+			return
+		}
+	case debugStepOut:
+		if L == stepThread && L.stackDepth() < stepDepth {
+			d.stop(L, "step")
+			return
+		}
+	}
+
+	if len(sources) == 0 {
+		return
+	}
+	C.lua_getinfo(L.s, coverageSourceInfo, ar)
+	chunk := chunkName(ar)
+	for _, s := range sources {
+		if sourceMatches(chunk, s) {
+			d.stop(L, "breakpoint")
+			return
+		}
+	}
+}
+
+// Reports whether the chunk named chunk is the file or chunk source
+func sourceMatches(chunk, source string) bool {
+	chunk = filepath.Clean(chunk)
+	if chunk == source || strings.HasSuffix(source, string(filepath.Separator)+chunk) {
+		return true
+	}
+	abs, err := filepath.Abs(chunk)
+	return err == nil && abs == source
+}
+
+// Blocks the lua code running in the thread L until the execution is
+// resumed, running the inspections requested in the meantime
+func (d *Debugger) stop(L *State, reason string) {
+	d.mu.Lock()
+	d.mode = debugRun
+	d.stopped = true
+	d.stopThread = L
+	d.stopDepth = L.stackDepth()
+	onStop := d.onStop
+	d.mu.Unlock()
+
+	if onStop != nil {
+		onStop(reason)
+	}
+	for {
+		select {
+		case f := <-d.work:
+			f()
+		case <-d.resume:
+			d.releaseRefs()
+			return
+		}
+	}
+}
+
+// Runs f on the stopped goroutine
+func (d *Debugger) do(f func()) error {
+	d.ctl.Lock()
+	defer d.ctl.Unlock()
+	if !d.Stopped() {
+		return ErrNotStopped
+	}
+	done := make(chan struct{})
+	d.work <- func() {
+		defer close(done)
+		f()
+	}
+	<-done
+	return nil
+}
+
+// Returns the number of active functions
+func (L *State) stackDepth() int {
+	var ar C.lua_Debug
+	n := 0
+	for C.lua_getstack(L.s, C.int(n), &ar) > 0 {
+		n++
+	}
+	return n
+}
+
+// Returns the stack of the stopped lua code, innermost function first.
+// The level of a frame, used by Scopes and Evaluate, is its position.
+func (d *Debugger) StackTrace() ([]LuaStackEntry, error) {
+	var st []LuaStackEntry
+	err := d.do(func() {
+		st = d.stopThread.stackTrace(false)
+	})
+	return st, err
+}
+
+// Returns the scopes of the stack frame at level: its local variables,
+// its upvalues and the global variables
+func (d *Debugger) Scopes(level int) ([]DebugScope, error) {
+	var scopes []DebugScope
+	err := d.do(func() {
+		scopes = []DebugScope{
+			{"Locals", d.newRef(debugRef{kind: debugRefLocals, level: level})},
+			{"Upvalues", d.newRef(debugRef{kind: debugRefUpvalues, level: level})},
+			{"Globals", d.newRef(debugRef{kind: debugRefGlobals})},
+		}
+	})
+	return scopes, err
+}
+
+// Returns the variables of a scope or the fields of a table, ref is the
+// Reference of a DebugScope or of a DebugVariable
+func (d *Debugger) Variables(ref int) ([]DebugVariable, error) {
+	var vars []DebugVariable
+	var verr error
+	err := d.do(func() {
+		if ref <= 0 || ref > len(d.refs) {
+			verr = fmt.Errorf("lua: unknown variables reference %d", ref)
+			return
+		}
+		vars, verr = d.variables(d.refs[ref-1])
+	})
+	if err != nil {
+		return nil, err
+	}
+	return vars, verr
+}
+
+// Evaluates the lua expression, or statement, expr in the stack frame at
+// level: its local variables and upvalues are visible, assigning them has
+// no effect on the frame.
+func (d *Debugger) Evaluate(level int, expr string) (DebugVariable, error) {
+	var v DebugVariable
+	var verr error
+	err := d.do(func() {
+		v, verr = d.evaluate(level, expr)
+	})
+	if err != nil {
+		return v, err
+	}
+	return v, verr
+}
+
+func (d *Debugger) newRef(r debugRef) int {
+	d.refs = append(d.refs, r)
+	return len(d.refs)
+}
+
+func (d *Debugger) releaseRefs() {
+	for _, r := range d.refs {
+		if r.kind == debugRefValue {
+			d.stopThread.Unref(LUA_REGISTRYINDEX, r.ref)
+		}
+	}
+	d.refs = nil
+}
+
+// Describes the value at index, tables get a reference to their fields
+func (d *Debugger) variable(name string, index int) DebugVariable {
+	L := d.stopThread
+	v := DebugVariable{Name: name, Type: L.LTypename(index), Value: L.describeValue(index)}
+	if L.IsTable(index) {
+		L.PushValue(index)
+		v.Reference = d.newRef(debugRef{kind: debugRefValue, ref: L.Ref(LUA_REGISTRYINDEX)})
+	}
+	return v
+}
+
+func (d *Debugger) variables(r debugRef) ([]DebugVariable, error) {
+	L := d.stopThread
+	if !L.CheckStack(4) {
+		return nil, errors.New("lua: stack overflow")
+	}
+	var vars []DebugVariable
+	switch r.kind {
+	case debugRefLocals, debugRefUpvalues:
+		var ar C.lua_Debug
+		if C.lua_getstack(L.s, C.int(r.level), &ar) == 0 {
+			return nil, fmt.Errorf("lua: no stack frame at level %d", r.level)
+		}
+		if r.kind == debugRefLocals {
+			L.frameLocals(&ar, func(name string) {
+				vars = append(vars, d.variable(name, -1))
+			})
+		} else {
+			L.frameUpvalues(&ar, func(name string) {
+				vars = append(vars, d.variable(name, -1))
+			})
+		}
+	case debugRefGlobals:
+		L.pushGlobalTable()
+		vars = d.fields(-1)
+		L.Pop(1)
+	case debugRefValue:
+		L.RawGeti(LUA_REGISTRYINDEX, r.ref)
+		vars = d.fields(-1)
+		L.Pop(1)
+	}
+	return vars, nil
+}
+
+// Calls f for each named local variable of the function activation ar,
+// with its value on top of the stack
+func (L *State) frameLocals(ar *C.lua_Debug, f func(name string)) {
+	for n := 1; ; n++ {
+		name := C.lua_getlocal(L.s, ar, C.int(n))
+		if name == nil {
+			return
+		}
+		if gname := C.GoString(name); !strings.HasPrefix(gname, "(") {
+			f(gname)
+		}
+		L.Pop(1)
+	}
+}
+
+// Calls f for each upvalue of the function activation ar, with its value
+// on top of the stack
+func (L *State) frameUpvalues(ar *C.lua_Debug, f func(name string)) {
+	C.lua_getinfo(L.s, stackFunctionInfo, ar)
+	for n := 1; ; n++ {
+		name := C.lua_getupvalue(L.s, -1, C.int(n))
+		if name == nil {
+			break
+		}
+		gname := C.GoString(name)
+		if gname == "" {
+			// upvalues of C functions have no name
+			gname = fmt.Sprintf("(upvalue %d)", n)
+		}
+		f(gname)
+		L.Pop(1)
+	}
+	L.Pop(1)
+}
+
+// lua_getinfo option pushing the function of an activation record
+var stackFunctionInfo = C.CString("f")
+
+// Lists the fields of the table at index, sorted by name
+func (d *Debugger) fields(index int) []DebugVariable {
+	L := d.stopThread
+	index = L.absIndex(index)
+	var vars []DebugVariable
+	L.PushNil()
+	for L.Next(index) != 0 {
+		if len(vars) == debugMaxChildren {
+			L.Pop(2)
+			break
+		}
+		var name string
+		if L.Type(-2) == LUA_TSTRING {
+			name = L.ToString(-2)
+		} else {
+			name = "[" + L.describeValue(-2) + "]"
+		}
+		vars = append(vars, d.variable(name, -1))
+		L.Pop(1)
+	}
+	sort.SliceStable(vars, func(i, j int) bool { return vars[i].Name < vars[j].Name })
+	return vars
+}
+
+func (d *Debugger) evaluate(level int, expr string) (DebugVariable, error) {
+	L := d.stopThread
+	var ar C.lua_Debug
+	if C.lua_getstack(L.s, C.int(level), &ar) == 0 {
+		return DebugVariable{}, fmt.Errorf("lua: no stack frame at level %d", level)
+	}
+	if !L.CheckStack(6) {
+		return DebugVariable{}, errors.New("lua: stack overflow")
+	}
+	top := L.GetTop()
+	defer L.SetTop(top)
+
+	if r := L.LoadString("return " + expr); r != 0 {
+		L.Pop(1)
+		if r := L.LoadString(expr); r != 0 {
+			return DebugVariable{}, L.LoadError(r)
+		}
+	}
+	fn := L.GetTop()
+
+	// environment: locals, then upvalues, then globals through __index
+	L.NewTable()
+	env := L.GetTop()
+	L.frameUpvalues(&ar, func(name string) {
+		L.PushValue(-1)
+		L.SetField(env, name)
+	})
+	L.frameLocals(&ar, func(name string) {
+		L.PushValue(-1)
+		L.SetField(env, name)
+	})
+	L.NewTable()
+	L.pushGlobalTable()
+	L.SetField(-2, "__index")
+	L.SetMetaTable(env)
+	L.setFunctionEnv(fn)
+
+	if err := L.Call(0, 1); err != nil {
+		return DebugVariable{}, err
+	}
+	return d.variable("result", -1), nil
+}
@@ -0,0 +1,143 @@
+//go:build go1.16
+// +build go1.16
+
+package lua
+
+import (
+	"errors"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// Registry key of the searcher installed by SetModuleFS
+const moduleFSSearcherKey = "golua_modulefs_searcher"
+
+// Like LoadFile but reads the file name from fsys, the chunk is named
+// after it so that error messages and stack traces show name. On failure
+// the error message is pushed on the stack and LUA_ERRFILE returned.
+func (L *State) LoadFileFS(fsys fs.FS, name string) int {
+	data, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		L.PushString("cannot open " + name + ": " + err.Error())
+		return LUA_ERRFILE
+	}
+	return L.loadSource(data, name)
+}
+
+// Like DoFile but reads the file name from fsys, for instance an
+// embed.FS. Returns the error of fsys if the file can't be read.
+func (L *State) DoFileFS(fsys fs.FS, name string) error {
+	data, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return err
+	}
+	if r := L.loadSource(data, name); r != 0 {
+		return L.LoadError(r)
+	}
+	return L.Call(0, LUA_MULTRET)
+}
+
+// Loads the content of the file name, a first line starting with # is
+// ignored as luaL_loadfile does
+func (L *State) loadSource(data []byte, name string) int {
+	if len(data) > 0 && data[0] == '#' {
+		data = append([]byte("--"), data...)
+	}
+	return L.Load(data, "@"+name)
+}
+
+// Makes require look for lua modules in fsys, before the files of
+// package.path. patterns are the paths tried for a module, where ? is
+// replaced by the name of the module with dots turned into slashes. They
+// default to "?.lua" and "?/init.lua". The chunks are named after the
+// path of their file.
+//
+// A later call replaces fsys and patterns, a nil fsys removes the
+// searcher. The package library must be open.
+func (L *State) SetModuleFS(fsys fs.FS, patterns ...string) error {
+	if len(patterns) == 0 {
+		patterns = []string{"?.lua", "?/init.lua"}
+	}
+
+	L.GetGlobal("package")
+	if !L.IsTable(-1) {
+		L.Pop(1)
+		return errors.New("lua: SetModuleFS needs the package library")
+	}
+	L.GetField(-1, "searchers")
+	if !L.IsTable(-1) {
+		L.Pop(1)
+		L.GetField(-1, "loaders")
+	}
+	if !L.IsTable(-1) {
+		L.Pop(2)
+		return errors.New("lua: package.searchers is not a table")
+	}
+	searchers := L.GetTop()
+
+	// remove the previous searcher
+	L.GetField(LUA_REGISTRYINDEX, moduleFSSearcherKey)
+	n := int(L.ObjLen(searchers))
+	for i := 1; i <= n && !L.IsNil(-1); i++ {
+		L.RawGeti(searchers, i)
+		found := L.RawEqual(-1, -2)
+		L.Pop(1)
+		if !found {
+			continue
+		}
+		for j := i; j < n; j++ {
+			L.RawGeti(searchers, j+1)
+			L.RawSeti(searchers, j)
+		}
+		L.PushNil()
+		L.RawSeti(searchers, n)
+		n--
+		break
+	}
+	L.Pop(1)
+
+	if fsys == nil {
+		L.PushNil()
+		L.SetField(LUA_REGISTRYINDEX, moduleFSSearcherKey)
+		L.Pop(2)
+		return nil
+	}
+
+	// after package.preload, before the files of package.path
+	for i := n; i >= 2; i-- {
+		L.RawGeti(searchers, i)
+		L.RawSeti(searchers, i+1)
+	}
+	L.PushGoClosure(func(L *State) int {
+		return searchModuleFS(L, fsys, patterns)
+	})
+	L.PushValue(-1)
+	L.SetField(LUA_REGISTRYINDEX, moduleFSSearcherKey)
+	L.RawSeti(searchers, 2)
+	L.Pop(2)
+	return nil
+}
+
+// Searcher of SetModuleFS, returns the loaded chunk and its path or a
+// message listing the paths that were tried
+func searchModuleFS(L *State, fsys fs.FS, patterns []string) int {
+	module := L.ToString(1)
+	file := strings.Replace(module, ".", "/", -1)
+	var tried strings.Builder
+	for _, pattern := range patterns {
+		name := path.Clean(strings.Replace(pattern, "?", file, -1))
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			tried.WriteString("\n\tno file '" + name + "' in the module FS")
+			continue
+		}
+		if L.loadSource(data, name) != 0 {
+			L.RaiseError("error loading module '" + module + "' from file '" + name + "':\n\t" + L.ToString(-1))
+		}
+		L.PushString(name)
+		return 2
+	}
+	L.PushString(tried.String())
+	return 1
+}
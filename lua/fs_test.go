@@ -0,0 +1,70 @@
+//go:build go1.16
+// +build go1.16
+
+package lua
+
+import (
+	"errors"
+	"io/fs"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestModuleFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"main.lua":          {Data: []byte("#!/usr/bin/lua\nlocal m = require 'lib.util'\nresult = m.twice(21)\n")},
+		"lib/util.lua":      {Data: []byte("local M = {}\nfunction M.twice(x) return 2 * x end\nreturn M\n")},
+		"lib/bad/init.lua":  {Data: []byte("local M = {}\nfunction M.fail() error('failed') end\nreturn M\n")},
+		"lib/broken.lua":    {Data: []byte("return {\n")},
+		"scripts/error.lua": {Data: []byte("\n\nerror('boom')\n")},
+	}
+
+	L := NewState()
+	defer L.Close()
+	L.OpenLibs()
+	if err := L.SetModuleFS(fsys); err != nil {
+		t.Fatalf("SetModuleFS: %v", err)
+	}
+
+	if err := L.DoFileFS(fsys, "main.lua"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	L.GetGlobal("result")
+	if L.ToInteger(-1) != 42 {
+		t.Fatalf("Wrong result: %v", L.ToInteger(-1))
+	}
+	L.Pop(1)
+
+	err := L.DoString(`require("lib.bad").fail()`)
+	if err == nil || !strings.Contains(err.Error(), "lib/bad/init.lua:2: failed") {
+		t.Fatalf("Wrong error for a module function: %v", err)
+	}
+
+	err = L.DoString(`require "lib.broken"`)
+	if err == nil || !strings.Contains(err.Error(), "lib/broken.lua") {
+		t.Fatalf("Wrong error for a broken module: %v", err)
+	}
+
+	err = L.DoString(`require "lib.missing"`)
+	if err == nil || !strings.Contains(err.Error(), "no file 'lib/missing.lua' in the module FS") {
+		t.Fatalf("Wrong error for a missing module: %v", err)
+	}
+
+	err = L.DoFileFS(fsys, "scripts/error.lua")
+	if err == nil || !strings.Contains(err.Error(), "scripts/error.lua:3: boom") {
+		t.Fatalf("Wrong error for a script: %v", err)
+	}
+
+	if err := L.DoFileFS(fsys, "nope.lua"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Expected fs.ErrNotExist, got %v", err)
+	}
+
+	// a nil FS removes the searcher
+	if err := L.SetModuleFS(nil); err != nil {
+		t.Fatalf("SetModuleFS: %v", err)
+	}
+	if err := L.DoString(`package.loaded["lib.util"] = nil; require "lib.util"`); err == nil {
+		t.Fatalf("Module found after removing the FS")
+	}
+}
@@ -0,0 +1,140 @@
+package lua
+
+import (
+	"reflect"
+)
+
+var typeOfError = reflect.TypeOf((*error)(nil)).Elem()
+var typeOfState = reflect.TypeOf((*State)(nil))
+
+// Pushes an arbitrary go function onto the stack as a lua function.
+//
+// Lua arguments are converted to the parameter types of fn with ToValue,
+// a conversion failure is reported like luaL_argerror does. If the first
+// parameter of fn is a *State it receives the calling state and doesn't
+// consume a lua argument. Variadic functions receive all the remaining
+// arguments. Results are pushed with PushGoValue, except for pointers to
+// structs which are pushed with PushGoStruct, and a non-nil trailing error
+// result is raised as a lua error.
+//
+// Panics if fn is not a function.
+func (L *State) PushFunc(fn interface{}) {
+	switch f := fn.(type) {
+	case LuaGoFunction:
+		L.PushGoClosure(f)
+		return
+	case func(*State) int:
+		L.PushGoClosure(f)
+		return
+	}
+	fv := reflect.ValueOf(fn)
+	if fv.Kind() != reflect.Func || fv.IsNil() {
+		panic("lua: PushFunc requires a non-nil function, got " + fv.Kind().String())
+	}
+	L.PushGoClosure(func(L *State) int {
+		return L.callReflect(fv, 1)
+	})
+}
+
+// Registers an arbitrary go function as a global variable, see PushFunc
+func (L *State) RegisterFunc(name string, fn interface{}) {
+	L.PushFunc(fn)
+	L.SetGlobal(name)
+}
+
+// Calls fn with the lua arguments found on the stack starting at index
+// first and pushes its results, returns the number of pushed results.
+// See PushFunc for the conversion rules.
+func (L *State) callReflect(fn reflect.Value, first int) int {
+	ft := fn.Type()
+	nin := ft.NumIn()
+	nargs := L.GetTop() - first + 1
+	if nargs < 0 {
+		nargs = 0
+	}
+
+	// parameters before skip are not taken from the lua stack
+	skip := 0
+	if nin > 0 && ft.In(0) == typeOfState {
+		skip = 1
+	}
+
+	fixed := nin - skip
+	if ft.IsVariadic() {
+		fixed--
+	}
+
+	if !L.CheckStack(fixed + 1) {
+		L.RaiseError("stack overflow")
+	}
+
+	n := fixed
+	if ft.IsVariadic() && nargs > fixed {
+		n = nargs
+	}
+	args := make([]reflect.Value, skip+n)
+	if skip == 1 {
+		args[0] = reflect.ValueOf(L)
+	}
+	for i := 0; i < n; i++ {
+		var t reflect.Type
+		if i < fixed {
+			t = ft.In(skip + i)
+		} else {
+			t = ft.In(nin - 1).Elem()
+		}
+		arg := reflect.New(t).Elem()
+		if err := L.decodeValue(first+i, arg, ""); err != nil {
+			L.RaiseError(L.argErrorMessage(first+i, err.Error()))
+		}
+		args[skip+i] = arg
+	}
+
+	out := fn.Call(args)
+
+	if nout := len(out); nout > 0 && ft.Out(nout-1) == typeOfError {
+		if err := out[nout-1]; !err.IsNil() {
+			L.RaiseGoError(err.Interface().(error))
+		}
+		out = out[:nout-1]
+	}
+
+	if !L.CheckStack(len(out)) {
+		L.RaiseError("stack overflow")
+	}
+	for _, r := range out {
+		if err := L.pushResult(r); err != nil {
+			L.RaiseError(err.Error())
+		}
+	}
+	return len(out)
+}
+
+// Pushes a value returned by a go function or method
+func (L *State) pushResult(r reflect.Value) error {
+	if r.Kind() == reflect.Interface && !r.IsNil() {
+		r = r.Elem()
+	}
+	if r.Kind() == reflect.Ptr && r.Type().Elem().Kind() == reflect.Struct {
+		if r.IsNil() {
+			L.PushNil()
+		} else {
+			L.PushGoStruct(r.Interface())
+		}
+		return nil
+	}
+	return L.PushGoValue(r.Interface())
+}
+
+// Pushes a function calling method m of the object iface pushed with
+// PushGoStruct. Both obj:Method(...) and obj.Method(...) are accepted.
+func (L *State) pushGoMethod(iface interface{}, m reflect.Value) {
+	comparable := reflect.TypeOf(iface).Comparable()
+	L.PushGoClosure(func(L *State) int {
+		first := 1
+		if comparable && L.IsGoStruct(1) && L.ToGoStruct(1) == iface {
+			first = 2
+		}
+		return L.callReflect(m, first)
+	})
+}
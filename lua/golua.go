@@ -13,7 +13,9 @@ package lua
 import "C"
 
 import (
+	"fmt"
 	"reflect"
+	"runtime/debug"
 	"sync"
 	"unsafe"
 )
@@ -39,6 +41,29 @@ type State struct {
 	// index of this object inside the goStates array
 	Index uintptr
 
+	// Stack trace recorded by the message handler for the error being
+	// propagated to callEx
+	errTrace []LuaStackEntry
+
+	// Registry ids of the go functions currently executing, innermost last
+	goCalls []uint
+
+	// Future the thread waits for, see Await
+	awaiting *Future
+
+	// Go side of the lua state, shared by the States of all its threads
+	*sharedState
+}
+
+// Go objects of a lua state and of all its threads
+type sharedState struct {
+	// State of the main thread
+	main *State
+
+	// State of the thread running the innermost go function, see
+	// Coroutine.Status
+	running *State
+
 	// Registry of go object that have been pushed to Lua VM
 	registry []interface{}
 
@@ -48,8 +73,63 @@ type State struct {
 	// User self defined memory alloc func for the lua State
 	allocfn *Alloc
 
-	// User defined hook function
-	hookFn HookFunction
+	// C allocated clua_memlimit of NewStateWithMemoryLimit, nil otherwise
+	memLimit unsafe.Pointer
+
+	// Hooks installed with AddHook, SetHook and SetExecutionLimit, the
+	// ids of the last two and the arguments of lua_sethook
+	hooks      []*hook
+	lastHookID HookID
+	userHook   HookID
+	limitHook  HookID
+	hookMask   int
+	hookCount  int
+
+	// Set when the execution limit is hit, pcall and xpcall don't catch
+	// the error until the outermost call returns
+	limitExceeded bool
+
+	// Error raised by the hook to abort the code run by CallContext once
+	// its context is done, and the call that set it. hookMu also
+	// serializes the calls to lua_sethook and protects threads.
+	hookMu       sync.Mutex
+	interruptErr error
+	interruptBy  chan struct{}
+
+	// States of the threads that called go code or were created by
+	// NewThread, indexed by their lua_State
+	threads map[*C.lua_State]*State
+
+	// Go errors and panics converted to lua errors by go callbacks,
+	// indexed by the error message that was raised in their place
+	goErrors map[string]*goError
+
+	// Number of errors returned by Call and Coroutine.Resume, see Pool
+	errorCount int
+
+	// Nesting level of callEx and Coroutine.Resume, pending goErrors and
+	// limitExceeded are discarded when the outermost call returns
+	callDepth int
+
+	// Whether stack traces collect the local variables of each frame
+	traceLocals bool
+
+	// CPU profile being recorded, see StartCPUProfile
+	profiler *profiler
+
+	// Hook recording the coverage, see StartCoverage
+	coverageHook HookID
+}
+
+// Go side of an error raised by a go callback
+type goError struct {
+	// go error the lua error was created from
+	cause error
+	// value passed to panic and goroutine stack, for go panics
+	panicValue interface{}
+	goStack    []byte
+	// lua stack trace taken inside the go function that raised the error
+	stackTrace []LuaStackEntry
 }
 
 var goStates map[uintptr]*State
@@ -78,180 +158,151 @@ func getGoState(gostateindex uintptr) *State {
 	return goStates[gostateindex]
 }
 
+// Go panics must not unwind through the C frames of the lua interpreter,
+// every go function called from C recovers them with
+//
+//	defer L.recoverCallback(&r, errcode)
+//
+// which pushes the error message on the stack and makes the callback
+// return errcode, the C side then raises the message with lua_error.
+// Panics raised by RaiseError become plain lua errors, errors raised by
+// RaiseGoError and other panics are also recorded so that callEx can
+// report their go error, panic value and go stack.
+func (L *State) recoverCallback(r *int, errcode int) {
+	p := recover()
+	if p == nil {
+		return
+	}
+
+	var msg string
+	var ge *goError
+	if le, ok := p.(*LuaError); ok {
+		msg = le.message
+		ge = &goError{cause: le.cause, stackTrace: le.stackTrace}
+	} else {
+		st := L.StackTrace()
+		ge = &goError{panicValue: p, goStack: debug.Stack(), stackTrace: st}
+		if err, ok := p.(error); ok {
+			ge.cause = err
+		}
+		msg = L.errorPrefix(st) + fmt.Sprintf("%v", p)
+	}
+
+	if L.goErrors == nil {
+		L.goErrors = make(map[string]*goError)
+	}
+	L.goErrors[msg] = ge
+
+	L.CheckStack(1)
+	L.PushString(msg)
+	*r = errcode
+}
+
 //export golua_callgofunction
-func golua_callgofunction(gostateindex uintptr, fid uint) int {
+func golua_callgofunction(gostateindex uintptr, fid uint) (r int) {
 	L1 := getGoState(gostateindex)
-	if fid < 0 {
-		panic(&LuaError{0, "Requested execution of an unknown function", L1.StackTrace()})
+	L1.goCalls = append(L1.goCalls, fid)
+	running := L1.running
+	L1.running = L1
+	defer func() {
+		L1.goCalls = L1.goCalls[:len(L1.goCalls)-1]
+		L1.running = running
+	}()
+	defer L1.recoverCallback(&r, callbackError)
+	if p := L1.profiler; p != nil {
+		defer p.leaveGo(p.enterGo())
+	}
+	if fid >= uint(len(L1.registry)) {
+		L1.RaiseError("Requested execution of an unknown function")
 	}
 	f := L1.registry[fid].(LuaGoFunction)
 	return f(L1)
 }
 
 //export golua_callgohook
-func golua_callgohook(gostateindex uintptr) {
+func golua_callgohook(gostateindex uintptr, ar *C.lua_Debug) (r int) {
 	L1 := getGoState(gostateindex)
-	if L1.hookFn != nil {
-		L1.hookFn(L1)
+	defer L1.recoverCallback(&r, callbackError)
+	if err := L1.interruptError(); err != nil {
+		L1.RaiseGoError(err)
 	}
+	L1.runHooks(ar)
+	return 0
 }
 
-var typeOfBytes = reflect.TypeOf([]byte(nil))
+// Called when pcall or xpcall (safe_pcall and safe_xpcall in c-golua.c)
+// starts, returns the number of go functions running in the thread
+//
+//export golua_pcallbegin
+func golua_pcallbegin(gostateindex uintptr) int {
+	return len(getGoState(gostateindex).goCalls)
+}
 
-//export golua_interface_newindex_callback
-func golua_interface_newindex_callback(gostateindex uintptr, iid uint, field_name_cstr *C.char) int {
+// Called when the function called by pcall or xpcall failed, with the
+// error value on top of the stack and depth returned by golua_pcallbegin.
+// The bookkeeping of the go functions the error unwound is repaired.
+// Errors that must end the outermost call, the execution limit and the
+// interruption of CallContext, are raised again instead of being caught.
+//
+//export golua_pcallerror
+func golua_pcallerror(gostateindex uintptr, depth int) (r int) {
 	L := getGoState(gostateindex)
-	iface := L.registry[iid]
-	ifacevalue := reflect.ValueOf(iface).Elem()
-
-	field_name := C.GoString(field_name_cstr)
-
-	fval := ifacevalue.FieldByName(field_name)
-
-	if fval.Kind() == reflect.Ptr {
-		fval = fval.Elem()
+	defer L.recoverCallback(&r, callbackError)
+	if depth < len(L.goCalls) {
+		L.goCalls = L.goCalls[:depth]
 	}
+	// set by an Await that couldn't yield
+	L.awaiting = nil
 
-	luatype := LuaValType(C.lua_type(L.s, 3))
-
-	switch fval.Kind() {
-	case reflect.Bool:
-		if luatype == LUA_TBOOLEAN {
-			fval.SetBool(int(C.lua_toboolean(L.s, 3)) != 0)
-			return 1
-		} else {
-			L.PushString("Wrong assignment to field " + field_name)
-			return -1
-		}
-
-	case reflect.Int:
-		fallthrough
-	case reflect.Int8:
-		fallthrough
-	case reflect.Int16:
-		fallthrough
-	case reflect.Int32:
-		fallthrough
-	case reflect.Int64:
-		if luatype == LUA_TNUMBER {
-			fval.SetInt(int64(luaToInteger(L.s, 3)))
-			return 1
-		} else {
-			L.PushString("Wrong assignment to field " + field_name)
-			return -1
-		}
-
-	case reflect.Uint:
-		fallthrough
-	case reflect.Uint8:
-		fallthrough
-	case reflect.Uint16:
-		fallthrough
-	case reflect.Uint32:
-		fallthrough
-	case reflect.Uint64:
-		if luatype == LUA_TNUMBER {
-			fval.SetUint(uint64(luaToInteger(L.s, 3)))
-			return 1
-		} else {
-			L.PushString("Wrong assignment to field " + field_name)
-			return -1
-		}
+	if err := L.interruptError(); err != nil {
+		L.RaiseGoError(err)
+	}
+	if L.limitExceeded {
+		L.RaiseError(ExecutionQuantumExceeded)
+	}
+	if L.Type(-1) == LUA_TSTRING {
+		delete(L.goErrors, L.ToString(-1))
+	}
+	return 0
+}
 
-	case reflect.String:
-		if luatype == LUA_TSTRING {
-			fval.SetString(C.GoString(C.lua_tolstring(L.s, 3, nil)))
-			return 1
-		} else {
-			L.PushString("Wrong assignment to field " + field_name)
-			return -1
-		}
+var typeOfBytes = reflect.TypeOf([]byte(nil))
 
-	case reflect.Float32:
-		fallthrough
-	case reflect.Float64:
-		if luatype == LUA_TNUMBER {
-			fval.SetFloat(float64(luaToNumber(L.s, 3)))
-			return 1
-		} else {
-			L.PushString("Wrong assignment to field " + field_name)
-			return -1
-		}
-	case reflect.Slice:
-		if fval.Type() == typeOfBytes {
-			if luatype == LUA_TSTRING {
-				fval.SetBytes(L.ToBytes(3))
-				return 1
-			} else {
-				L.PushString("Wrong assignment to field " + field_name)
-				return -1
-			}
-		}
+func cFieldName(field_name *C.char) (string, bool) {
+	if field_name == nil {
+		return "", false
 	}
+	return C.GoString(field_name), true
+}
 
-	L.PushString("Unsupported type of field " + field_name + ": " + fval.Type().String())
-	return -1
+//export golua_interface_newindex_callback
+func golua_interface_newindex_callback(gostateindex uintptr, iid uint, field_name_cstr *C.char) (r int) {
+	L := getGoState(gostateindex)
+	defer L.recoverCallback(&r, -1)
+	name, hasName := cFieldName(field_name_cstr)
+	return L.proxyNewIndex(L.registry[iid], name, hasName)
 }
 
 //export golua_interface_index_callback
-func golua_interface_index_callback(gostateindex uintptr, iid uint, field_name *C.char) int {
+func golua_interface_index_callback(gostateindex uintptr, iid uint, field_name *C.char) (r int) {
 	L := getGoState(gostateindex)
-	iface := L.registry[iid]
-	ifacevalue := reflect.ValueOf(iface).Elem()
-
-	fval := ifacevalue.FieldByName(C.GoString(field_name))
-
-	if fval.Kind() == reflect.Ptr {
-		fval = fval.Elem()
-	}
+	defer L.recoverCallback(&r, -1)
+	name, hasName := cFieldName(field_name)
+	return L.proxyIndex(L.registry[iid], name, hasName)
+}
 
-	switch fval.Kind() {
-	case reflect.Bool:
-		L.PushBoolean(fval.Bool())
-		return 1
-
-	case reflect.Int:
-		fallthrough
-	case reflect.Int8:
-		fallthrough
-	case reflect.Int16:
-		fallthrough
-	case reflect.Int32:
-		fallthrough
-	case reflect.Int64:
-		L.PushInteger(fval.Int())
-		return 1
-
-	case reflect.Uint:
-		fallthrough
-	case reflect.Uint8:
-		fallthrough
-	case reflect.Uint16:
-		fallthrough
-	case reflect.Uint32:
-		fallthrough
-	case reflect.Uint64:
-		L.PushInteger(int64(fval.Uint()))
-		return 1
-
-	case reflect.String:
-		L.PushString(fval.String())
-		return 1
-
-	case reflect.Float32:
-		fallthrough
-	case reflect.Float64:
-		L.PushNumber(fval.Float())
-		return 1
-	case reflect.Slice:
-		if fval.Type() == typeOfBytes {
-			L.PushBytes(fval.Bytes())
-			return 1
-		}
-	}
+//export golua_interface_len_callback
+func golua_interface_len_callback(gostateindex uintptr, iid uint) (r int) {
+	L := getGoState(gostateindex)
+	defer L.recoverCallback(&r, -1)
+	return L.proxyLen(L.registry[iid])
+}
 
-	L.PushString("Unsupported type of field: " + fval.Type().String())
-	return -1
+//export golua_interface_pairs_callback
+func golua_interface_pairs_callback(gostateindex uintptr, iid uint, ipairs int) (r int) {
+	L := getGoState(gostateindex)
+	defer L.recoverCallback(&r, -1)
+	return L.proxyPairs(L.registry[iid], ipairs != 0)
 }
 
 //export golua_gchook
@@ -261,6 +312,34 @@ func golua_gchook(gostateindex uintptr, id uint) int {
 	return 0
 }
 
+//export golua_awaitresult
+func golua_awaitresult(gostateindex uintptr) (r int) {
+	L1 := getGoState(gostateindex)
+	defer L1.recoverCallback(&r, callbackError)
+	f := L1.awaiting
+	L1.awaiting = nil
+	if f == nil {
+		return 0
+	}
+	n, err := L1.pushFutureResults(f)
+	if err != nil {
+		L1.RaiseGoError(err)
+	}
+	return n
+}
+
+//export golua_newthreadstate
+func golua_newthreadstate(gostateindex uintptr, l *C.lua_State) uintptr {
+	return getGoState(gostateindex).newThreadState(l).Index
+}
+
+//export golua_freethreadstate
+func golua_freethreadstate(gostateindex uintptr) {
+	if L := getGoState(gostateindex); L != nil {
+		L.freeThreadState()
+	}
+}
+
 //export golua_callpanicfunction
 func golua_callpanicfunction(gostateindex uintptr, id uint) int {
 	L1 := getGoState(gostateindex)
@@ -279,14 +358,25 @@ func golua_cfunctiontointerface(f *uintptr) interface{} {
 }
 
 //export golua_callallocf
-func golua_callallocf(fp uintptr, ptr uintptr, osize uint, nsize uint) uintptr {
+func golua_callallocf(fp uintptr, ptr uintptr, osize uint, nsize uint) (r uintptr) {
+	// a panicking allocator is reported to lua as an allocation failure
+	defer func() {
+		if recover() != nil {
+			r = 0
+		}
+	}()
 	return uintptr((*((*Alloc)(unsafe.Pointer(fp))))(unsafe.Pointer(ptr), osize, nsize))
 }
 
+// Message handler used by callEx, records the stack trace at the point the
+// error was raised, without the frame of the handler itself. The error
+// value is left untouched.
+//
 //export go_panic_msghandler
 func go_panic_msghandler(gostateindex uintptr, z *C.char) {
 	L := getGoState(gostateindex)
-	s := C.GoString(z)
-
-	panic(&LuaError{LUA_ERRERR, s, L.StackTrace()})
+	L.errTrace = L.StackTrace()
+	if len(L.errTrace) > 0 {
+		L.errTrace = L.errTrace[1:]
+	}
 }
@@ -4,9 +4,23 @@ typedef struct { void *t; void *v; } GoInterface;
 
 #define GOLUA_DEFAULT_MSGHANDLER "golua_default_msghandler"
 
+/* returned by go callbacks when they have pushed an error message that must be raised */
+#define GOLUA_CALLBACK_ERROR (-2)
+
+/* returned by go functions that suspend the coroutine until a Future completes */
+#define GOLUA_CALLBACK_YIELD (-3)
+
+/* memory accounting of the states created by NewStateWithMemoryLimit */
+typedef struct {
+	size_t used;
+	size_t peak;
+	size_t limit;
+} clua_memlimit;
+
 /* function to setup metatables, etc */
 void clua_initstate(lua_State* L);
 void clua_hide_pcall(lua_State *L);
+void clua_trackcoroutines(lua_State *L);
 
 unsigned int clua_togofunction(lua_State* L, int index);
 unsigned int clua_togostruct(lua_State *L, int index);
@@ -21,6 +35,7 @@ GoInterface clua_atpanic(lua_State* L, unsigned int panicf_id);
 int clua_callluacfunc(lua_State* L, lua_CFunction f);
 lua_State* clua_newstate(void* goallocf);
 void clua_setallocf(lua_State* L, void* goallocf);
+lua_State* clua_newstate_memlimit(clua_memlimit* m);
 
 void clua_openbase(lua_State* L);
 void clua_openio(lua_State* L);
@@ -29,9 +44,11 @@ void clua_openpackage(lua_State* L);
 void clua_openstring(lua_State* L);
 void clua_opentable(lua_State* L);
 void clua_openos(lua_State* L);
-void clua_sethook(lua_State* L, int n);
+void clua_sethook(lua_State* L, int mask, int n);
+void clua_unsethook(lua_State* L);
 
 int clua_isgofunction(lua_State *L, int n);
 int clua_isgostruct(lua_State *L, int n);
 int clua_upvalueindex(int n);
+int clua_isgocallback(lua_State *L, int index);
 
@@ -36,17 +36,15 @@ static int writer (lua_State *L, const void* b, size_t size, void* B) {
 	return 0;
 }
 
-// load function chunk dumped from dump_chunk
+// load function chunk dumped from dump_chunk or lua source code
 int load_chunk(lua_State *L, char *b, int size, const char* chunk_name) {
 	chunk ck;
 	ck.buffer = b;
 	ck.size = size;
 	int err;
 	err = lua_load(L, reader, &ck, chunk_name);
-	if (err != 0) {
-		return luaL_error(L, "unable to load chunk, err: %d", err);
-	}
-	return 0;
+	// the error message is left on the stack, as luaL_loadbuffer does
+	return err;
 }
 
 void clua_openio(lua_State* L)
@@ -151,6 +149,12 @@ func (L *State) ToInteger(index int) int {
 	return int(C.lua_tointeger(L.s, C.int(index)))
 }
 
+// Returns the value at index if it is stored as an integer, lua 5.1 and
+// 5.2 only have floating point numbers
+func (L *State) toInt64(index int) (int64, bool) {
+	return 0, false
+}
+
 // lua_tonumber
 func (L *State) ToNumber(index int) float64 {
 	return float64(C.lua_tonumber(L.s, C.int(index)))
@@ -161,6 +165,36 @@ func (L *State) Yield(nresults int) int {
 	return int(C.lua_yield(L.s, C.int(nresults)))
 }
 
+// lua_getinfo options used by StackTrace
+const stackInfoOptions = "Slnf"
+
+// Hook mask that enables LUA_HOOKTAILRET events
+const hookTailMask = LUA_MASKRET
+
+// Event of the hook calls for functions entered through a tail call, lua
+// 5.1 reports them as ordinary calls
+const hookTailCallEvent = LUA_HOOKCALL
+
+// Whether go functions can run again when a coroutine suspended by Await
+// is resumed, without lua_yieldk the results of the Future are passed to
+// lua_resume and its error can't be raised
+const yieldContinuations = false
+
+// Reports whether the frame described by d is a tail call placeholder
+func isTailCall(d *C.lua_Debug) bool {
+	return C.GoString(d.what) == "tail"
+}
+
+// Pushes the table of the global variables
+func (L *State) pushGlobalTable() {
+	C.lua_pushvalue(L.s, C.LUA_GLOBALSINDEX)
+}
+
+// Pops a table and makes it the environment of the lua function at index
+func (L *State) setFunctionEnv(index int) {
+	C.lua_setfenv(L.s, C.int(index))
+}
+
 func (L *State) pcall(nargs, nresults, errfunc int) int {
 	return int(C.lua_pcall(L.s, C.int(nargs), C.int(nresults), C.int(errfunc)))
 }
@@ -173,6 +207,13 @@ func (L *State) Resume(narg int) int {
 	return int(C.lua_resume(L.s, C.int(narg)))
 }
 
+// lua_resume, also returns the number of values yielded or returned, the
+// whole stack of the thread
+func (L *State) resume(narg int) (int, int) {
+	r := L.Resume(narg)
+	return r, L.GetTop()
+}
+
 // lua_setglobal
 func (L *State) SetGlobal(name string) {
 	Cname := C.CString(name)
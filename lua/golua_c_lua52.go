@@ -36,17 +36,15 @@ static int writer (lua_State *L, const void* b, size_t size, void* B) {
 	return 0;
 }
 
-// load function chunk dumped from dump_chunk
+// load function chunk dumped from dump_chunk or lua source code
 int load_chunk(lua_State *L, char *b, int size, const char* chunk_name) {
 	chunk ck;
 	ck.buffer = b;
 	ck.size = size;
 	int err;
 	err = lua_load(L, reader, &ck, chunk_name, NULL);
-	if (err != 0) {
-		return luaL_error(L, "unable to load chunk, err: %d", err);
-	}
-	return 0;
+	// the error message is left on the stack, as luaL_loadbuffer does
+	return err;
 }
 
 void clua_openio(lua_State* L)
@@ -85,6 +83,9 @@ void clua_openos(lua_State* L)
 	lua_pop(L, 1);
 }
 
+// defined in c-golua.c
+void clua_trackcoroutines(lua_State *L);
+
 void clua_opencoroutine(lua_State *L)
 {
 	luaL_requiref(L, "coroutine", &luaopen_coroutine, 1);
@@ -158,6 +159,12 @@ func (L *State) ToInteger(index int) int {
 	return int(C.lua_tointegerx(L.s, C.int(index), nil))
 }
 
+// Returns the value at index if it is stored as an integer, lua 5.1 and
+// 5.2 only have floating point numbers
+func (L *State) toInt64(index int) (int64, bool) {
+	return 0, false
+}
+
 // lua_tonumber
 func (L *State) ToNumber(index int) float64 {
 	return float64(C.lua_tonumberx(L.s, C.int(index), nil))
@@ -168,6 +175,35 @@ func (L *State) Yield(nresults int) int {
 	return int(C.lua_yieldk(L.s, C.int(nresults), 0, nil))
 }
 
+// lua_getinfo options used by StackTrace
+const stackInfoOptions = "Slnft"
+
+// Hook mask that enables LUA_HOOKTAILCALL events
+const hookTailMask = LUA_MASKCALL
+
+// Event of the hook calls for functions entered through a tail call
+const hookTailCallEvent = LUA_HOOKTAILCALL
+
+// Whether go functions can run again when a coroutine suspended by Await
+// is resumed, through the continuation given to lua_yieldk
+const yieldContinuations = true
+
+// Reports whether the frame described by d was entered through a tail call
+func isTailCall(d *C.lua_Debug) bool {
+	return d.istailcall != 0
+}
+
+// Pushes the table of the global variables
+func (L *State) pushGlobalTable() {
+	C.lua_rawgeti(L.s, C.LUA_REGISTRYINDEX, C.LUA_RIDX_GLOBALS)
+}
+
+// Pops a table and makes it the environment of the lua function at index,
+// which must have been loaded from source: its first upvalue is _ENV
+func (L *State) setFunctionEnv(index int) {
+	C.lua_setupvalue(L.s, C.int(index), 1)
+}
+
 func (L *State) pcall(nargs, nresults, errfunc int) int {
 	return int(C.lua_pcallk(L.s, C.int(nargs), C.int(nresults), C.int(errfunc), 0, nil))
 }
@@ -184,6 +220,13 @@ func (L *State) Resume(narg int) int {
 	return int(C.lua_resume(L.s, nil, C.int(narg)))
 }
 
+// lua_resume, also returns the number of values yielded or returned, the
+// whole stack of the thread
+func (L *State) resume(narg int) (int, int) {
+	r := L.Resume(narg)
+	return r, L.GetTop()
+}
+
 // lua_setglobal
 func (L *State) SetGlobal(name string) {
 	Cname := C.CString(name)
@@ -204,6 +247,7 @@ func (L *State) OpenBit32() {
 // Calls luaopen_coroutine
 func (L *State) OpenCoroutine() {
 	C.clua_opencoroutine(L.s)
+	C.clua_trackcoroutines(L.s)
 }
 
 // lua_insert
@@ -0,0 +1,166 @@
+package lua
+
+//#include <lua.h>
+//#include <stdlib.h>
+//#include "golua.h"
+import "C"
+import "unsafe"
+
+// Identifies a hook installed with AddHook
+type HookID int
+
+// Activation record passed to the hooks installed with AddHook
+type HookInfo struct {
+	// LUA_HOOKCALL, LUA_HOOKRET, LUA_HOOKLINE, LUA_HOOKCOUNT or, for tail
+	// calls, LUA_HOOKTAILRET on lua 5.1 and LUA_HOOKTAILCALL since 5.2
+	Event int
+
+	// The function running when the event happened. For LUA_HOOKLINE
+	// events CurrentLine is the new line.
+	LuaStackEntry
+}
+
+// Type of the go functions that can be installed with AddHook
+type DebugHookFunction func(L *State, info *HookInfo)
+
+type hook struct {
+	id    HookID
+	mask  int
+	count int
+	// instructions executed since the hook was last called
+	pending int
+
+	fn      DebugHookFunction
+	countFn HookFunction
+	// called with the activation record given to the C hook
+	rawFn func(L *State, ar *C.lua_Debug)
+}
+
+// Installs f as a hook for the events in mask, a combination of
+// LUA_MASKCALL, LUA_MASKRET, LUA_MASKLINE and LUA_MASKCOUNT. With
+// LUA_MASKCOUNT f is also called every count instructions.
+//
+// Any number of hooks can be installed, they are called in the order they
+// were added. When several count hooks are installed lua counts with the
+// smallest count and the others are called once at least their count of
+// instructions has been executed.
+//
+// A hook can interrupt the running code with RaiseError.
+func (L *State) AddHook(mask int, count int, f DebugHookFunction) HookID {
+	return L.addHook(&hook{mask: mask, count: count, fn: f})
+}
+
+// Removes a hook installed with AddHook
+func (L *State) RemoveHook(id HookID) {
+	for i, h := range L.hooks {
+		if h.id == id {
+			L.hooks = append(L.hooks[:i:i], L.hooks[i+1:]...)
+			break
+		}
+	}
+	L.hookMu.Lock()
+	defer L.hookMu.Unlock()
+	L.installHooks()
+}
+
+func (L *State) addHook(h *hook) HookID {
+	L.lastHookID++
+	h.id = L.lastHookID
+	if h.count <= 0 {
+		h.mask &^= LUA_MASKCOUNT
+	}
+	L.hooks = append(L.hooks, h)
+	L.hookMu.Lock()
+	defer L.hookMu.Unlock()
+	L.installHooks()
+	return h.id
+}
+
+// Sets the lua hook of every thread to the union of the installed hooks,
+// hookMu must be held. While a CallContext is interrupted its hook is left
+// in place.
+func (L *State) installHooks() {
+	mask, count := 0, 0
+	for _, h := range L.hooks {
+		mask |= h.mask
+		if h.mask&LUA_MASKCOUNT != 0 && (count == 0 || h.count < count) {
+			count = h.count
+		}
+	}
+	L.hookMask, L.hookCount = mask, count
+	L.applyAllHooks()
+}
+
+// Calls applyHooks for the main thread and every thread with a State,
+// hookMu must be held
+func (L *State) applyAllHooks() {
+	L.main.applyHooks()
+	for _, T := range L.threads {
+		T.applyHooks()
+	}
+}
+
+// Gives lua_sethook the hooks of the state, or the hook raising the
+// interruption error of CallContext, hookMu must be held
+func (L *State) applyHooks() {
+	switch {
+	case L.interruptErr != nil:
+		C.clua_sethook(L.s, LUA_MASKCOUNT, 1)
+	case L.hookMask == 0:
+		C.clua_unsethook(L.s)
+	default:
+		C.clua_sethook(L.s, C.int(L.hookMask), C.int(L.hookCount))
+	}
+}
+
+// Calls the hooks interested in the event described by ar
+func (L *State) runHooks(ar *C.lua_Debug) {
+	event := int(ar.event)
+	var mask int
+	switch event {
+	case LUA_HOOKCALL:
+		mask = LUA_MASKCALL
+	case LUA_HOOKRET:
+		mask = LUA_MASKRET
+	case LUA_HOOKLINE:
+		mask = LUA_MASKLINE
+	case LUA_HOOKCOUNT:
+		mask = LUA_MASKCOUNT
+	default:
+		mask = hookTailMask
+	}
+
+	var info *HookInfo
+	// hooks may add or remove hooks
+	hooks := append([]*hook(nil), L.hooks...)
+	for _, h := range hooks {
+		if h.mask&mask == 0 {
+			continue
+		}
+		if event == LUA_HOOKCOUNT {
+			h.pending += L.hookCount
+			if h.pending < h.count {
+				continue
+			}
+			h.pending -= h.count
+		}
+		if h.countFn != nil {
+			h.countFn(L)
+			continue
+		}
+		if h.rawFn != nil {
+			h.rawFn(L, ar)
+			continue
+		}
+		if info == nil {
+			info = L.hookInfo(ar)
+		}
+		h.fn(L, info)
+	}
+}
+
+func (L *State) hookInfo(ar *C.lua_Debug) *HookInfo {
+	opts := C.CString(stackInfoOptions)
+	defer C.free(unsafe.Pointer(opts))
+	return &HookInfo{Event: int(ar.event), LuaStackEntry: L.stackEntry(ar, opts)}
+}
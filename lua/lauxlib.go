@@ -6,12 +6,22 @@ package lua
 //#include <stdlib.h>
 //#include "golua.h"
 import "C"
-import "unsafe"
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unsafe"
+)
 
 type LuaError struct {
 	code       int
 	message    string
 	stackTrace []LuaStackEntry
+	panicValue interface{}
+	goStack    []byte
+	value      interface{}
+	cause      error
 }
 
 func (err *LuaError) Error() string {
@@ -26,6 +36,140 @@ func (err *LuaError) StackTrace() []LuaStackEntry {
 	return err.stackTrace
 }
 
+// A syntax error reported while compiling a chunk with LoadString, LoadFile
+// or Load (see LoadError)
+type SyntaxError struct {
+	// Chunk name as lua shows it: file name, [string "..."] for strings
+	Chunk string
+	// Line where the error was detected
+	Line int
+	// Description of the error, without position and offending token
+	Message string
+	// The token the error was detected at, without quotes, "<eof>" at
+	// the end of the chunk. Empty when lua didn't report one.
+	Near string
+
+	raw string
+}
+
+func (err *SyntaxError) Error() string {
+	return err.raw
+}
+
+// chunk:line: message [near token]
+var syntaxErrorPattern = regexp.MustCompile(`(?s)^(\[string ".*?"\]|.*?):(\d+): (.*)$`)
+
+// Parses a syntax error message in the format used by every supported lua
+// version. lua 5.1 and LuaJIT quote every token ("near '<eof>'"), later
+// versions leave <eof> unquoted.
+func parseSyntaxError(msg string) *SyntaxError {
+	err := &SyntaxError{Message: msg, raw: msg}
+	m := syntaxErrorPattern.FindStringSubmatch(msg)
+	if m == nil {
+		return err
+	}
+	err.Chunk = m[1]
+	err.Line, _ = strconv.Atoi(m[2])
+	err.Message = m[3]
+	if i := strings.LastIndex(err.Message, " near "); i >= 0 {
+		near := err.Message[i+len(" near "):]
+		if len(near) >= 2 && near[0] == '\'' && near[len(near)-1] == '\'' {
+			near = near[1 : len(near)-1]
+		}
+		err.Message, err.Near = err.Message[:i], near
+	}
+	return err
+}
+
+// Returns the error for the non-zero result code of LoadString, LoadFile
+// or Load, taking the error message they left on top of the stack. Syntax
+// errors are returned as *SyntaxError, other errors (unreadable files,
+// memory errors) as *LuaError. The message is left on the stack.
+func (L *State) LoadError(code int) error {
+	msg := L.ToString(-1)
+	if code == LUA_ERRSYNTAX {
+		return parseSyntaxError(msg)
+	}
+	return &LuaError{code: code, message: msg, value: msg}
+}
+
+// Returns the error message followed by its stack trace, formatted like
+// the output of debug.traceback. Go frames are shown as [Go] together with
+// the name of the go function and, when they were collected (see
+// SetStackTraceLocals), the local variables of every frame are listed
+// under it.
+func (err *LuaError) Traceback() string {
+	var b strings.Builder
+	b.WriteString(err.message)
+	b.WriteString("\nstack traceback:")
+	for _, e := range err.stackTrace {
+		b.WriteString("\n\t")
+		b.WriteString(e.String())
+		for _, l := range e.Locals {
+			fmt.Fprintf(&b, "\n\t\t%s = %s", l.Name, l.Value)
+		}
+		if e.TailCall && e.What != "tail" {
+			b.WriteString("\n\t(...tail calls...)")
+		}
+	}
+	return b.String()
+}
+
+// Returns the line describing the frame in a traceback
+func (e LuaStackEntry) String() string {
+	var b strings.Builder
+	if e.What == "Go" {
+		b.WriteString("[Go]:")
+	} else {
+		b.WriteString(e.ShortSource + ":")
+	}
+	if e.CurrentLine > 0 {
+		fmt.Fprintf(&b, "%d:", e.CurrentLine)
+	}
+	switch {
+	case e.NameWhat != "":
+		fmt.Fprintf(&b, " in function '%s'", e.Name)
+		if e.GoFunction != "" {
+			fmt.Fprintf(&b, " (%s)", e.GoFunction)
+		}
+	case e.What == "main":
+		b.WriteString(" in main chunk")
+	case e.What == "Lua":
+		fmt.Fprintf(&b, " in function <%s:%d>", e.ShortSource, e.LineDefined)
+	case e.GoFunction != "":
+		fmt.Fprintf(&b, " in function <%s>", e.GoFunction)
+	default:
+		b.WriteString(" ?")
+	}
+	return b.String()
+}
+
+// Returns the lua value the error was raised with, converted to go as
+// ToValue does for an interface{}: error("x") gives "x", error({code=404})
+// gives map[string]interface{}{"code": int64(404)}
+func (err *LuaError) Value() interface{} {
+	return err.value
+}
+
+// Returns the go error this error was created from, when it was raised by
+// a go function with RaiseGoError, by returning a non-nil error or by
+// panicking with an error
+func (err *LuaError) Unwrap() error {
+	return err.cause
+}
+
+// Returns the value passed to panic when the error was caused by a go panic
+// inside a go function called by lua, nil otherwise
+func (err *LuaError) PanicValue() interface{} {
+	return err.panicValue
+}
+
+// Returns the stack of the goroutine that panicked when the error was
+// caused by a go panic inside a go function called by lua, nil otherwise
+func (err *LuaError) GoStackTrace() []byte {
+	return err.goStack
+}
+
 // luaL_argcheck
 // WARNING: before b30b2c62c6712c6683a9d22ff0abfa54c8267863 the function ArgCheck had the opposite behaviour
 func (L *State) Argcheck(cond bool, narg int, extramsg string) {
@@ -99,18 +243,20 @@ func (L *State) UdataToBytes(narg int, nsize int) []byte {
 	return buf
 }
 
-// Executes file, returns nil for no errors or the lua error string on failure
+// Executes file, returns nil for no errors or the lua error on failure,
+// a *SyntaxError if the file doesn't compile
 func (L *State) DoFile(filename string) error {
 	if r := L.LoadFile(filename); r != 0 {
-		return &LuaError{r, L.ToString(-1), L.StackTrace()}
+		return L.LoadError(r)
 	}
 	return L.Call(0, LUA_MULTRET)
 }
 
-// Executes the string, returns nil for no errors or the lua error string on failure
+// Executes the string, returns nil for no errors or the lua error on
+// failure, a *SyntaxError if the string doesn't compile
 func (L *State) DoString(str string) error {
 	if r := L.LoadString(str); r != 0 {
-		return &LuaError{r, L.ToString(-1), L.StackTrace()}
+		return L.LoadError(r)
 	}
 	return L.Call(0, LUA_MULTRET)
 }
@@ -150,14 +296,14 @@ func (L *State) GSub(s string, p string, r string) string {
 	return C.GoString(C.luaL_gsub(L.s, Cs, Cp, Cr))
 }
 
-// luaL_loadfile
+// luaL_loadfile, a non-zero result can be turned into an error with LoadError
 func (L *State) LoadFile(filename string) int {
 	Cfilename := C.CString(filename)
 	defer C.free(unsafe.Pointer(Cfilename))
 	return int(lualLoadFile(L.s, Cfilename))
 }
 
-// luaL_loadstring
+// luaL_loadstring, a non-zero result can be turned into an error with LoadError
 func (L *State) LoadString(s string) int {
 	Cs := C.CString(s)
 	defer C.free(unsafe.Pointer(Cs))
@@ -170,17 +316,13 @@ func (L *State) Dump() int {
 	return ret
 }
 
-// lua_load
+// lua_load, a non-zero result can be turned into an error with LoadError
 func (L *State) Load(bs []byte, name string) int {
 	chunk := C.CString(string(bs))
 	ckname := C.CString(name)
 	defer C.free(unsafe.Pointer(chunk))
 	defer C.free(unsafe.Pointer(ckname))
-	ret := int(C.load_chunk(L.s, chunk, C.int(len(bs)), ckname))
-	if ret != 0 {
-		return ret
-	}
-	return 0
+	return int(C.load_chunk(L.s, chunk, C.int(len(bs)), ckname))
 }
 
 // luaL_newmetatable
@@ -204,6 +346,8 @@ func NewState() *State {
 func (L *State) OpenLibs() {
 	C.luaL_openlibs(L.s)
 	C.clua_hide_pcall(L.s)
+	C.clua_trackcoroutines(L.s)
+	L.saveBasePrint()
 }
 
 // luaL_optinteger
@@ -45,18 +45,57 @@ package lua
 import "C"
 import (
 	"fmt"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
 	"unsafe"
 )
 
+// Returned by go callbacks that have pushed an error for the C side to raise
+const callbackError = C.GOLUA_CALLBACK_ERROR
+
+// Returned by Await to make the C wrapper of the go function yield
+const callbackYield = C.GOLUA_CALLBACK_YIELD
+
 type LuaStackEntry struct {
 	Name        string
 	Source      string
 	ShortSource string
 	CurrentLine int
+
+	// Kind of function: "Lua", "C", "main" or "Go" for go functions pushed
+	// with PushGoFunction or PushGoClosure (lua 5.1 also reports "tail"
+	// for the placeholders of tail calls)
+	What string
+	// How Name was found: "global", "local", "method", "field", "upvalue"
+	// or "" when the function has no known name
+	NameWhat        string
+	LineDefined     int
+	LastLineDefined int
+	// The function was entered through a tail call, the frames of its
+	// callers are lost
+	TailCall bool
+	// Full name of the go function for "Go" frames
+	GoFunction string
+	// Local variables of the frame, only collected after
+	// SetStackTraceLocals(true)
+	Locals []LuaLocal
+}
+
+// A local variable captured in a LuaStackEntry
+type LuaLocal struct {
+	Name string
+	// Lua type name of the value
+	Type string
+	// Short description of the value, strings are quoted and cut after
+	// a few dozen bytes, tables, functions and userdata show their address
+	Value string
 }
 
 func newState(L *C.lua_State) *State {
-	newstate := &State{L, 0, make([]interface{}, 0, 8), make([]uint, 0, 8), nil, nil}
+	newstate := &State{s: L, sharedState: &sharedState{registry: make([]interface{}, 0, 8), freeIndices: make([]uint, 0, 8)}}
+	newstate.main = newstate
 	registerGoState(newstate)
 	C.clua_setgostate(L, C.size_t(newstate.Index))
 	C.clua_initstate(L)
@@ -159,7 +198,10 @@ func (L *State) SetMetaMethod(methodName string, f LuaGoFunction) {
 
 // Pushes a Go struct onto the stack as user data.
 //
-// The user data will be rigged so that lua code can access and change to public members of simple types directly
+// The user data will be rigged so that lua code can access and change to public members of simple types directly,
+// call exported methods and reach nested structs, maps and slices through live proxies supporting #, pairs and ipairs
+// (pairs and ipairs metamethods are not honoured by lua 5.1).
+// Maps, slices and arrays, or pointers to them, can also be pushed directly.
 func (L *State) PushGoStruct(iface interface{}) {
 	iid := L.register(iface)
 	C.clua_pushgostruct(L.s, C.uint(iid))
@@ -215,14 +257,18 @@ func (L *State) callEx(nargs, nresults int, catch bool) (err error) {
 		}()
 	}
 
-	L.GetGlobal(C.GOLUA_DEFAULT_MSGHANDLER)
+	L.enterCall()
+	defer L.exitCall()
+
+	L.GetField(LUA_REGISTRYINDEX, C.GOLUA_DEFAULT_MSGHANDLER)
 	// We must record where we put the error handler in the stack otherwise it will be impossible to remove after the pcall when nresults == LUA_MULTRET
 	erridx := L.GetTop() - nargs - 1
 	L.Insert(erridx)
+	L.errTrace = nil
 	r := L.pcall(nargs, nresults, erridx)
 	L.Remove(erridx)
 	if r != 0 {
-		err = &LuaError{r, L.ToString(-1), L.StackTrace()}
+		err = L.callError(r)
 		if !catch {
 			panic(err)
 		}
@@ -230,6 +276,71 @@ func (L *State) callEx(nargs, nresults int, catch bool) (err error) {
 	return
 }
 
+// Called when go starts running lua code, with callEx or Coroutine.Resume
+func (L *State) enterCall() {
+	if L.callDepth == 0 && L.profiler != nil {
+		L.profiler.resume()
+	}
+	L.callDepth++
+}
+
+// Called when the lua code started by enterCall returns to go
+func (L *State) exitCall() {
+	L.callDepth--
+	if L.callDepth == 0 {
+		L.goErrors = nil
+		L.limitExceeded = false
+	}
+}
+
+// Builds the error returned by callEx out of the error value on top of
+// the stack and of what was recorded while the error was propagating
+func (L *State) callError(code int) *LuaError {
+	L.errorCount++
+	// set by an Await that couldn't yield
+	L.awaiting = nil
+	st := L.errTrace
+	L.errTrace = nil
+	if st == nil {
+		st = L.StackTrace()
+	}
+
+	value, _ := L.decodeInterface(L.GetTop(), "", 0)
+	msg := L.errorMessage(-1)
+
+	err := &LuaError{code: code, message: msg, stackTrace: st, value: value}
+	if ge, ok := L.goErrors[msg]; ok && L.Type(-1) == LUA_TSTRING {
+		delete(L.goErrors, msg)
+		err.cause = ge.cause
+		err.panicValue = ge.panicValue
+		err.goStack = ge.goStack
+		if ge.stackTrace != nil {
+			err.stackTrace = ge.stackTrace
+		}
+	}
+	return err
+}
+
+// Returns a message describing the error value at index, using its
+// __tostring metamethod for values that aren't strings or numbers
+func (L *State) errorMessage(index int) string {
+	switch L.Type(index) {
+	case LUA_TSTRING, LUA_TNUMBER:
+		return L.ToString(index)
+	}
+	index = L.absIndex(index)
+	if L.CheckStack(2) && L.GetMetaField(index, "__tostring") {
+		L.PushValue(index)
+		if L.pcall(1, 1, 0) == 0 && L.Type(-1) == LUA_TSTRING {
+			msg := L.ToString(-1)
+			L.Pop(1)
+			return msg
+		}
+		L.Pop(1)
+	}
+	return fmt.Sprintf("(error object is a %s value)", L.LTypename(index))
+}
+
 // lua_call
 func (L *State) Call(nargs, nresults int) (err error) {
 	return L.callEx(nargs, nresults, true)
@@ -251,10 +362,14 @@ func (L *State) CheckStack(extra int) bool {
 	return C.lua_checkstack(L.s, C.int(extra)) != 0
 }
 
-// lua_close
+// lua_close, the whole state is closed when L is the State of a thread
 func (L *State) Close() {
-	C.lua_close(L.s)
-	unregisterGoState(L)
+	C.lua_close(L.main.s)
+	unregisterGoState(L.main)
+	if L.memLimit != nil {
+		C.free(L.memLimit)
+		L.memLimit = nil
+	}
 }
 
 // lua_concat
@@ -346,18 +461,111 @@ func NewStateAlloc(f Alloc) *State {
 	return L
 }
 
+// Creates a new lua interpreter state whose memory is limited to limit
+// bytes, 0 means no limit. Allocations that would exceed the limit fail
+// and lua reports them as LUA_ERRMEM errors from Call, DoString and the
+// other protected calls.
+//
+// The limit is enforced by an allocator written in C that also tracks the
+// memory in use, see MemoryUsage, MemoryPeak and SetMemoryLimit.
+// Allocations made by other API calls are not protected: running out of
+// memory there is fatal, as it is for any lua state.
+//
+// Returns nil if the state can't be created, LuaJIT on 64 bits platforms
+// doesn't support custom allocators.
+func NewStateWithMemoryLimit(limit uint) *State {
+	m := (*C.clua_memlimit)(C.calloc(1, C.size_t(unsafe.Sizeof(C.clua_memlimit{}))))
+	m.limit = C.size_t(limit)
+	ls := C.clua_newstate_memlimit(m)
+	if ls == nil {
+		C.free(unsafe.Pointer(m))
+		return nil
+	}
+	L := newState(ls)
+	L.memLimit = unsafe.Pointer(m)
+	return L
+}
+
+// Returns the memory limit of a state created with
+// NewStateWithMemoryLimit, 0 for no limit
+func (L *State) MemoryLimit() uint {
+	if L.memLimit == nil {
+		return 0
+	}
+	return uint((*C.clua_memlimit)(L.memLimit).limit)
+}
+
+// Changes the memory limit of a state created with NewStateWithMemoryLimit,
+// 0 removes the limit. A limit below the memory in use only makes further
+// allocations fail. Has no effect on other states.
+func (L *State) SetMemoryLimit(limit uint) {
+	if L.memLimit != nil {
+		(*C.clua_memlimit)(L.memLimit).limit = C.size_t(limit)
+	}
+}
+
+// Returns the bytes currently allocated by a state created with
+// NewStateWithMemoryLimit, 0 for other states
+func (L *State) MemoryUsage() uint {
+	if L.memLimit == nil {
+		return 0
+	}
+	return uint((*C.clua_memlimit)(L.memLimit).used)
+}
+
+// Returns the highest number of bytes allocated at once by a state created
+// with NewStateWithMemoryLimit, 0 for other states
+func (L *State) MemoryPeak() uint {
+	if L.memLimit == nil {
+		return 0
+	}
+	return uint((*C.clua_memlimit)(L.memLimit).peak)
+}
+
 // lua_newtable
 func (L *State) NewTable() {
 	C.lua_createtable(L.s, 0, 0)
 }
 
 // lua_newthread
+//
+// The thread, left on the stack, shares the globals and the go registry of
+// L, go functions called by it receive the returned State. The State must
+// not be used after lua has collected the thread, keep a reference to it
+// for as long as it is needed (see NewCoroutine).
 func (L *State) NewThread() *State {
-	//TODO: call newState with result from C.lua_newthread and return it
-	//TODO: should have same lists as parent
-	//		but may complicate gc
-	s := C.lua_newthread(L.s)
-	return &State{s, 0, nil, nil, nil, nil}
+	return L.threadState(C.lua_newthread(L.s))
+}
+
+// Returns the State of the thread l of L, creating it if needed
+func (L *State) threadState(l *C.lua_State) *State {
+	return getGoState(uintptr(C.clua_getgostate(l)))
+}
+
+// Creates the State of the thread l, called by clua_getgostate the first
+// time l needs one
+func (L *State) newThreadState(l *C.lua_State) *State {
+	T := &State{s: l, sharedState: L.sharedState}
+	registerGoState(T)
+	L.hookMu.Lock()
+	defer L.hookMu.Unlock()
+	if L.threads == nil {
+		L.threads = make(map[*C.lua_State]*State)
+	}
+	L.threads[l] = T
+	T.applyHooks()
+	return T
+}
+
+// Forgets the State of a thread collected by lua
+func (L *State) freeThreadState() {
+	L.hookMu.Lock()
+	// a new thread may already have been allocated at the same address
+	if L.threads[L.s] == L {
+		delete(L.threads, L.s)
+	}
+	L.hookMu.Unlock()
+	unregisterGoState(L)
 }
 
 // lua_next
@@ -500,7 +708,8 @@ func (L *State) ToGoStruct(index int) (f interface{}) {
 	if fid < 0 {
 		return nil
 	}
-	return L.registry[fid]
+	iface, _ := unwrapProxy(L.registry[fid])
+	return iface
 }
 
 // lua_tostring
@@ -522,9 +731,15 @@ func (L *State) ToPointer(index int) uintptr {
 }
 
 // lua_tothread
+//
+// Returns the State of the thread, the same for every call, or nil if the
+// value at index isn't a thread.
 func (L *State) ToThread(index int) *State {
-	//TODO: find a way to link lua_State* to existing *State, return that
-	return &State{}
+	l := C.lua_tothread(L.s, C.int(index))
+	if l == nil {
+		return nil
+	}
+	return L.threadState(l)
 }
 
 // lua_touserdata
@@ -552,6 +767,7 @@ func XMove(from *State, to *State, n int) {
 // Calls luaopen_base
 func (L *State) OpenBase() {
 	C.clua_openbase(L.s)
+	L.saveBasePrint()
 }
 
 // Calls luaopen_io
@@ -584,57 +800,246 @@ func (L *State) OpenOS() {
 	C.clua_openos(L.s)
 }
 
-// Sets the lua hook (lua_sethook).
-// This and SetExecutionLimit are mutual exclusive
+// Sets a hook called every instrNumber instructions, replacing the one set
+// by a previous call to SetHook. A nil f removes it. Hooks installed with
+// SetExecutionLimit and AddHook keep running.
 func (L *State) SetHook(f HookFunction, instrNumber int) {
-	L.hookFn = f
-	C.clua_sethook(L.s, C.int(instrNumber))
+	if L.userHook != 0 {
+		L.RemoveHook(L.userHook)
+		L.userHook = 0
+	}
+	if f != nil {
+		L.userHook = L.addHook(&hook{mask: LUA_MASKCOUNT, count: instrNumber, countFn: f})
+	}
 }
 
-// Sets the maximum number of operations to execute at instrNumber, after this the execution ends
-// This and SetHook are mutual exclusive
+// Sets the maximum number of operations to execute at instrNumber, after this the execution ends.
+// Replaces the limit set by a previous call, hooks installed with SetHook and AddHook keep running.
 func (L *State) SetExecutionLimit(instrNumber int) {
-	L.SetHook(func(l *State) {
+	if L.limitHook != 0 {
+		L.RemoveHook(L.limitHook)
+	}
+	L.limitHook = L.addHook(&hook{mask: LUA_MASKCOUNT, count: instrNumber, countFn: func(l *State) {
+		l.limitExceeded = true
 		l.RaiseError(ExecutionQuantumExceeded)
-	}, instrNumber)
+	}})
+}
+
+// Makes the hook raise err at the next instruction, on behalf of the
+// CallContext identified by by. Safe to call while lua code is running
+// in another goroutine, as lua_sethook is.
+func (L *State) interrupt(by chan struct{}, err error) {
+	L.hookMu.Lock()
+	defer L.hookMu.Unlock()
+	if L.interruptErr != nil {
+		return
+	}
+	L.interruptErr = err
+	L.interruptBy = by
+	L.applyAllHooks()
+}
+
+// Undoes interrupt once the CallContext identified by by has returned,
+// the hooks are installed again. Returns the error it was interrupted with.
+func (L *State) clearInterrupt(by chan struct{}) error {
+	L.hookMu.Lock()
+	defer L.hookMu.Unlock()
+	if L.interruptBy != by {
+		return nil
+	}
+	err := L.interruptErr
+	L.interruptErr = nil
+	L.interruptBy = nil
+	L.installHooks()
+	return err
+}
+
+// Returns the error set by interrupt, if any
+func (L *State) interruptError() error {
+	L.hookMu.Lock()
+	defer L.hookMu.Unlock()
+	return L.interruptErr
 }
 
 // Returns the current stack trace
 func (L *State) StackTrace() []LuaStackEntry {
+	return L.stackTrace(L.traceLocals)
+}
+
+func (L *State) stackTrace(locals bool) []LuaStackEntry {
 	r := []LuaStackEntry{}
 	var d C.lua_Debug
-	Sln := C.CString("Sln")
-	defer C.free(unsafe.Pointer(Sln))
+	opts := C.CString(stackInfoOptions)
+	defer C.free(unsafe.Pointer(opts))
+
+	// a local variable and a copy of it, the function pushed by
+	// lua_getinfo is popped first
+	if !L.CheckStack(2) {
+		return r
+	}
 
+	gocall := len(L.goCalls)
 	for depth := 0; C.lua_getstack(L.s, C.int(depth), &d) > 0; depth++ {
-		C.lua_getinfo(L.s, Sln, &d)
-		ssb := make([]byte, C.LUA_IDSIZE)
-		for i := 0; i < C.LUA_IDSIZE; i++ {
-			ssb[i] = byte(d.short_src[i])
-			if ssb[i] == 0 {
-				ssb = ssb[:i]
-				break
-			}
+		e := L.stackEntry(&d, opts)
+		// go functions are entered and left in lua call order, the
+		// innermost go frame belongs to the last entry of goCalls
+		if e.What == "Go" && gocall > 0 {
+			gocall--
+			e.GoFunction = goFunctionName(L.registry[L.goCalls[gocall]])
 		}
-		ss := string(ssb)
-
-		r = append(r, LuaStackEntry{C.GoString(d.name), C.GoString(d.source), ss, int(d.currentline)})
+		if locals {
+			e.Locals = L.stackLocals(&d)
+		}
+		r = append(r, e)
 	}
 
 	return r
 }
 
-func (L *State) RaiseError(msg string) {
-	st := L.StackTrace()
-	prefix := ""
+// Describes the function activation d with lua_getinfo, opts must include
+// stackInfoOptions. Needs one free stack slot.
+func (L *State) stackEntry(d *C.lua_Debug, opts *C.char) LuaStackEntry {
+	C.lua_getinfo(L.s, opts, d)
+	ssb := make([]byte, C.LUA_IDSIZE)
+	for i := 0; i < C.LUA_IDSIZE; i++ {
+		ssb[i] = byte(d.short_src[i])
+		if ssb[i] == 0 {
+			ssb = ssb[:i]
+			break
+		}
+	}
+	ss := string(ssb)
+
+	e := LuaStackEntry{
+		Name:            C.GoString(d.name),
+		Source:          C.GoString(d.source),
+		ShortSource:     ss,
+		CurrentLine:     int(d.currentline),
+		What:            C.GoString(d.what),
+		NameWhat:        C.GoString(d.namewhat),
+		LineDefined:     int(d.linedefined),
+		LastLineDefined: int(d.lastlinedefined),
+		TailCall:        isTailCall(d),
+	}
+	if C.clua_isgocallback(L.s, -1) != 0 {
+		e.What = "Go"
+	}
+	L.Pop(1)
+	return e
+}
+
+// Makes StackTrace, and so the stack traces of errors, collect the local
+// variables of every frame. Disabled by default.
+func (L *State) SetStackTraceLocals(enabled bool) {
+	L.traceLocals = enabled
+}
+
+// Returns the local variables of the active function described by d,
+// internal variables such as "(for index)" are skipped
+func (L *State) stackLocals(d *C.lua_Debug) []LuaLocal {
+	var locals []LuaLocal
+	for n := 1; ; n++ {
+		name := C.lua_getlocal(L.s, d, C.int(n))
+		if name == nil {
+			break
+		}
+		if gname := C.GoString(name); !strings.HasPrefix(gname, "(") {
+			locals = append(locals, LuaLocal{
+				Name:  gname,
+				Type:  L.LTypename(-1),
+				Value: L.describeValue(-1),
+			})
+		}
+		L.Pop(1)
+	}
+	return locals
+}
+
+// Maximum number of bytes of a string shown by describeValue
+const describeMaxString = 40
+
+// Describes the value at index without calling any metamethod
+func (L *State) describeValue(index int) string {
+	switch L.Type(index) {
+	case LUA_TNIL:
+		return "nil"
+	case LUA_TBOOLEAN:
+		return strconv.FormatBool(L.ToBoolean(index))
+	case LUA_TNUMBER:
+		// lua_tostring would change the type of the value on the stack
+		L.PushValue(index)
+		s := L.ToString(-1)
+		L.Pop(1)
+		return s
+	case LUA_TSTRING:
+		s := L.ToString(index)
+		if len(s) > describeMaxString {
+			return strconv.Quote(s[:describeMaxString]) + "..."
+		}
+		return strconv.Quote(s)
+	}
+	return fmt.Sprintf("%s: %p", L.LTypename(index), C.lua_topointer(L.s, C.int(index)))
+}
+
+// Returns the name of a go function kept in the registry
+func goFunctionName(f interface{}) string {
+	v := reflect.ValueOf(f)
+	if v.Kind() != reflect.Func {
+		return ""
+	}
+	if fn := runtime.FuncForPC(v.Pointer()); fn != nil {
+		return fn.Name()
+	}
+	return ""
+}
+
+// Formats an argument error message the same way luaL_argerror does
+func (L *State) argErrorMessage(narg int, extramsg string) string {
+	var d C.lua_Debug
+	if C.lua_getstack(L.s, 0, &d) == 0 {
+		return fmt.Sprintf("bad argument #%d (%s)", narg, extramsg)
+	}
+	n := C.CString("n")
+	defer C.free(unsafe.Pointer(n))
+	C.lua_getinfo(L.s, n, &d)
+	if d.namewhat != nil && C.GoString(d.namewhat) == "method" {
+		narg--
+		if narg == 0 {
+			return fmt.Sprintf("calling '%s' on bad self (%s)", C.GoString(d.name), extramsg)
+		}
+	}
+	name := "?"
+	if d.name != nil {
+		name = C.GoString(d.name)
+	}
+	return fmt.Sprintf("bad argument #%d to '%s' (%s)", narg, name, extramsg)
+}
+
+// Returns the position prefix lua adds to errors raised by the function
+// calling the one at the top of stack trace st
+func (L *State) errorPrefix(st []LuaStackEntry) string {
 	if len(st) >= 2 {
-		prefix = fmt.Sprintf("%s:%d: ", st[1].ShortSource, st[1].CurrentLine)
+		return fmt.Sprintf("%s:%d: ", st[1].ShortSource, st[1].CurrentLine)
 	}
-	panic(&LuaError{0, prefix + msg, st})
+	return ""
+}
+
+// Raises a lua error with the given message from inside a go function or
+// hook, the go function is interrupted and its caller receives the error
+func (L *State) RaiseError(msg string) {
+	st := L.StackTrace()
+	panic(&LuaError{message: L.errorPrefix(st) + msg, stackTrace: st})
+}
+
+// Like RaiseError but raises err, the LuaError returned to the go code
+// that started the lua call wraps err (see LuaError.Unwrap)
+func (L *State) RaiseGoError(err error) {
+	st := L.StackTrace()
+	panic(&LuaError{message: L.errorPrefix(st) + err.Error(), stackTrace: st, cause: err})
 }
 
 func (L *State) NewError(msg string) *LuaError {
-	return &LuaError{0, msg, L.StackTrace()}
+	return &LuaError{message: msg, stackTrace: L.StackTrace()}
 }
 
 func (L *State) GetState() *C.lua_State {
@@ -52,6 +52,7 @@ const (
 	LUA_HOOKRET       = C.LUA_HOOKRET
 	LUA_HOOKLINE      = C.LUA_HOOKLINE
 	LUA_HOOKCOUNT     = C.LUA_HOOKCOUNT
+	LUA_HOOKTAILCALL  = C.LUA_HOOKTAILCALL
 	LUA_MASKCALL      = C.LUA_MASKCALL
 	LUA_MASKRET       = C.LUA_MASKRET
 	LUA_MASKLINE      = C.LUA_MASKLINE
@@ -1,7 +1,23 @@
 package lua
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/textproto"
+	"runtime"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 	"unsafe"
 )
 
@@ -78,19 +94,103 @@ func TestCheckStringFail(t *testing.T) {
 	}
 }
 
-func TestPCallHidden(t *testing.T) {
+func TestPCall(t *testing.T) {
 	L := NewState()
 	L.OpenLibs()
 	defer L.Close()
 
-	err := L.DoString("pcall(print, \"ciao\")")
-	if err == nil {
-		t.Fatal("Can use pcall\n")
+	L.Register("crash", func(L *State) int {
+		var m map[string]int
+		m["x"] = 1
+		return 0
+	})
+	L.Register("fail", func(L *State) int {
+		L.RaiseGoError(errNotFound)
+		return 0
+	})
+
+	err := L.DoString(`
+		assert(type(pcall) == "function" and type(xpcall) == "function")
+		assert(unsafe_pcall and unsafe_xpcall)
+
+		local ok, a, b = pcall(function(x, y) return x + y, x * y end, 2, 3)
+		assert(ok and a == 5 and b == 6)
+
+		local ok, msg = pcall(error, "boom")
+		assert(not ok and msg == "boom")
+
+		ok, msg = pcall(crash)
+		assert(not ok and msg:find("nil map"))
+
+		ok, msg = pcall(fail)
+		assert(not ok and msg:find("not found"))
+
+		ok, msg = xpcall(fail, function(m) return "handled: " .. m end)
+		assert(not ok and msg:find("^handled: .*not found"))
+
+		ok, msg = xpcall(function(x) return x end, print, 42)
+		assert(ok and msg == 42)
+	`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// the execution limit can't be caught
+	L.SetExecutionLimit(1000)
+	err = L.DoString(`
+		for i = 1, 100 do
+			pcall(function() while true do end end)
+		end
+	`)
+	if err == nil || !strings.Contains(err.Error(), ExecutionQuantumExceeded) {
+		t.Fatalf("Expected the execution limit to be hit, got %v", err)
+	}
+}
+
+func TestPCallYield(t *testing.T) {
+	if LUA_VERSION_NUM < 502 {
+		t.Skip("coroutines can't yield across pcall before lua 5.2")
+	}
+	L := NewState()
+	L.OpenLibs()
+	defer L.Close()
+
+	err := L.DoString(`
+		local co = coroutine.wrap(function()
+			local ok, v = pcall(function() return coroutine.yield(1) + 1 end)
+			assert(ok and v == 11)
+			local ok, msg = pcall(function() coroutine.yield(2); error("after yield") end)
+			assert(not ok and msg:find("after yield"))
+			local ok, v = xpcall(function(x) return coroutine.yield(3) * x end, tostring, 2)
+			assert(ok and v == 8)
+			return "done"
+		end)
+		assert(co() == 1 and co(10) == 2 and co() == 3 and co(4) == "done")
+	`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
 	}
 
-	err = L.DoString("unsafe_pcall(print, \"ciao\")")
+	// Await under pcall
+	L.Register("later", func(L *State) int {
+		return L.Await(Async(func() ([]interface{}, error) {
+			return []interface{}{5}, nil
+		}))
+	})
+	if r := L.LoadString(`local ok, v = pcall(later); return ok, v`); r != 0 {
+		t.Fatalf("LoadString: %v", L.LoadError(r))
+	}
+	co, err := L.NewCoroutine()
 	if err != nil {
-		t.Fatal("Can not use unsafe_pcall\n")
+		t.Fatalf("NewCoroutine: %v", err)
+	}
+	defer co.Close()
+	results, done, err := co.Resume()
+	for err == nil && !done {
+		results, done, err = co.Resume()
+	}
+	if err != nil || len(results) != 2 || results[0] != true || results[1] != int64(5) {
+		t.Fatalf("Wrong results: %v, %v", results, err)
 	}
 }
 
@@ -343,11 +443,14 @@ func TestStackTrace(t *testing.T) {
 
 	le := err.(*LuaError)
 
-	if le.Code() != LUA_ERRERR {
-		t.Fatalf("Wrong kind of error encountered running calls.lua: %v (%d %d)\n", le, le.Code(), LUA_ERRERR)
+	// the message handler no longer fails, which was reported as LUA_ERRERR
+	if le.Code() != LUA_ERRRUN {
+		t.Fatalf("Wrong kind of error encountered running calls.lua: %v (%d %d)\n", le, le.Code(), LUA_ERRRUN)
 	}
 
-	if len(le.StackTrace()) != 6 {
+	// error, call3, call2, call1 and the main chunk, the frame of the
+	// message handler used to be the sixth
+	if len(le.StackTrace()) != 5 {
 		t.Fatalf("Wrong size of stack trace (%v)\n", le.StackTrace())
 	}
 }
@@ -435,3 +538,1670 @@ func TestCustomDebugHook(t *testing.T) {
 		}
 	}
 }
+
+func TestPushGoValue(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	L.OpenLibs()
+
+	type Inner struct {
+		Port  uint16
+		Ratio float32
+	}
+	type Outer struct {
+		Name    string `lua:"name"`
+		Hidden  int    `lua:"-"`
+		Tags    []string
+		Labels  map[string]int
+		Inner   Inner
+		Ptr     *Inner
+		Raw     []byte
+		Missing *Inner
+	}
+
+	v := &Outer{
+		Name:   "srv",
+		Hidden: 1,
+		Tags:   []string{"a", "b"},
+		Labels: map[string]int{"env": 3},
+		Inner:  Inner{8080, 0.5},
+		Ptr:    &Inner{Port: 1},
+		Raw:    []byte("raw"),
+	}
+
+	if err := L.PushGoValue(v); err != nil {
+		t.Fatalf("PushGoValue: %v", err)
+	}
+	L.SetGlobal("v")
+
+	err := L.DoString(`
+		assert(v.name == "srv")
+		assert(v.Hidden == nil)
+		assert(#v.Tags == 2 and v.Tags[2] == "b")
+		assert(v.Labels.env == 3)
+		assert(v.Inner.Port == 8080 and v.Inner.Ratio == 0.5)
+		assert(v.Ptr.Port == 1)
+		assert(v.Raw == "raw")
+		assert(v.Missing == nil)
+	`)
+	if err != nil {
+		t.Fatalf("Wrong conversion: %v", err)
+	}
+
+	type Node struct {
+		Next *Node
+	}
+	n := &Node{}
+	n.Next = n
+	top := L.GetTop()
+	if err := L.PushGoValue(n); err == nil {
+		t.Fatal("Cycle not detected")
+	}
+	if L.GetTop() != top {
+		t.Fatal("Stack not restored after error")
+	}
+
+	deep := []interface{}{[]interface{}{[]interface{}{1}}}
+	if err := L.PushGoValueDepth(deep, 2); err == nil {
+		t.Fatal("Depth limit not enforced")
+	}
+}
+
+func TestToValue(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	L.OpenLibs()
+
+	type Server struct {
+		Host string `lua:"host"`
+		Port int    `lua:"port"`
+	}
+	type Config struct {
+		Name    string            `lua:"name"`
+		Retries int               `lua:"retries,3"`
+		Servers []Server          `lua:"servers"`
+		Labels  map[string]string `lua:"labels"`
+		Limits  *struct{ Max uint8 }
+		Extra   interface{} `lua:"extra"`
+	}
+
+	err := L.DoString(`return {
+		name = "cfg",
+		servers = { { host = "a", port = 1 }, { host = "b", port = 2 } },
+		labels = { env = "prod" },
+		Limits = { Max = 7 },
+		extra = { 1, 2, 3 },
+	}`)
+	if err != nil {
+		t.Fatalf("DoString: %v", err)
+	}
+
+	var cfg Config
+	if err := L.ToValue(-1, &cfg); err != nil {
+		t.Fatalf("ToValue: %v", err)
+	}
+	L.Pop(1)
+
+	if cfg.Name != "cfg" || cfg.Retries != 3 || len(cfg.Servers) != 2 || cfg.Servers[1].Port != 2 {
+		t.Fatalf("Wrong decoding: %#v", cfg)
+	}
+	if cfg.Labels["env"] != "prod" || cfg.Limits == nil || cfg.Limits.Max != 7 {
+		t.Fatalf("Wrong decoding: %#v", cfg)
+	}
+	if extra, ok := cfg.Extra.([]interface{}); !ok || len(extra) != 3 || extra[2] != int64(3) {
+		t.Fatalf("Wrong decoding of interface field: %#v", cfg.Extra)
+	}
+
+	err = L.DoString(`return { servers = { {}, {}, { host = "c", port = "80" } } }`)
+	if err != nil {
+		t.Fatalf("DoString: %v", err)
+	}
+	err = L.ToValue(-1, &cfg)
+	L.Pop(1)
+	if err == nil {
+		t.Fatal("Type mismatch not reported")
+	}
+	if err.Error() != "servers[3].port: expected integer, got string" {
+		t.Fatalf("Wrong error message: %v", err)
+	}
+
+	// arrays longer than the table
+	if err := L.DoString(`return { { host = "a" } }`); err != nil {
+		t.Fatalf("DoString: %v", err)
+	}
+	servers := [3]Server{{Port: 1}, {Port: 2}, {Port: 3}}
+	err = L.ToValue(-1, &servers)
+	L.Pop(1)
+	if err != nil || servers[0].Host != "a" || servers[1] != (Server{}) || servers[2] != (Server{}) {
+		t.Fatalf("Wrong decoding of a short table: %v, %#v", err, servers)
+	}
+
+	L.PushNumber(1.5)
+	var i int
+	if err := L.ToValue(-1, &i); err == nil {
+		t.Fatal("Non integral number decoded as integer")
+	}
+	L.Pop(1)
+
+	// integers of lua 5.3 and later are read without a float conversion
+	if err := L.DoString(`return math.maxinteger`); err != nil {
+		t.Fatalf("DoString: %v", err)
+	}
+	if !L.IsNil(-1) {
+		var max int64
+		if err := L.ToValue(-1, &max); err != nil || max != math.MaxInt64 {
+			t.Fatalf("Wrong decoding of math.maxinteger: %v, %v", max, err)
+		}
+	}
+	L.Pop(1)
+}
+
+type MethodStruct struct {
+	Count int
+}
+
+func (m *MethodStruct) Add(n int) int {
+	m.Count += n
+	return m.Count
+}
+
+func (m MethodStruct) Describe(prefix string) (string, int) {
+	return prefix + "count", m.Count
+}
+
+func (m *MethodStruct) Fail(msg string) error {
+	if msg != "" {
+		return errors.New(msg)
+	}
+	return nil
+}
+
+func TestGoStructMethods(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	L.OpenLibs()
+
+	m := &MethodStruct{}
+	L.PushGoStruct(m)
+	L.SetGlobal("m")
+
+	err := L.DoString(`
+		assert(m:Add(2) == 2)
+		assert(m.Add(3) == 5)
+		local s, c = m:Describe("the ")
+		assert(s == "the count" and c == 5)
+		m:Fail("")
+	`)
+	if err != nil {
+		t.Fatalf("Method call failed: %v", err)
+	}
+	if m.Count != 5 {
+		t.Fatalf("Method did not modify receiver (%d)", m.Count)
+	}
+
+	err = L.DoString(`m:Fail("boom")`)
+	if err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Fatalf("Error result not raised: %v", err)
+	}
+
+	err = L.DoString(`m:Add("x")`)
+	if err == nil || !strings.Contains(err.Error(), "bad argument #1 to 'Add'") {
+		t.Fatalf("Wrong argument error: %v", err)
+	}
+}
+
+func TestRegisterFunc(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	L.OpenLibs()
+
+	L.RegisterFunc("add", func(a, b int) int { return a + b })
+	L.RegisterFunc("join", func(sep string, parts ...string) string { return strings.Join(parts, sep) })
+	L.RegisterFunc("top", func(L *State, n int) (int, int) { return L.GetTop(), n })
+	L.RegisterFunc("fail", func() (string, error) { return "", errors.New("failed") })
+
+	err := L.DoString(`
+		assert(add(1, 2) == 3)
+		assert(join(",", "a", "b", "c") == "a,b,c")
+		assert(join(",") == "")
+		local top, n = top(7)
+		assert(top == 1 and n == 7)
+	`)
+	if err != nil {
+		t.Fatalf("Call to registered function failed: %v", err)
+	}
+
+	err = L.DoString(`fail()`)
+	if err == nil || !strings.Contains(err.Error(), "failed") {
+		t.Fatalf("Error result not raised: %v", err)
+	}
+
+	err = L.DoString(`add(1, "two")`)
+	if err == nil || !strings.Contains(err.Error(), "bad argument #2 to 'add' (expected integer, got string)") {
+		t.Fatalf("Wrong argument error: %v", err)
+	}
+}
+
+func TestGoStructProxies(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	L.OpenLibs()
+
+	type Limits struct {
+		MaxConns int
+	}
+	type Config struct {
+		Limits Limits
+		Tags   []string
+		Labels map[string]string
+		Ports  [2]int
+		Nodes  map[string]Limits
+		Max    uint64
+	}
+
+	cfg := &Config{Tags: []string{"a", "b"}, Labels: map[string]string{"env": "dev"}, Nodes: map[string]Limits{"a": {1}}, Max: math.MaxUint64}
+	L.PushGoStruct(cfg)
+	L.SetGlobal("cfg")
+	if err := L.PushGoValue(*cfg); err != nil {
+		t.Fatalf("PushGoValue: %v", err)
+	}
+	L.SetGlobal("copy")
+
+	err := L.DoString(`
+		cfg.Limits.MaxConns = 10
+		assert(cfg.Tags[2] == "b")
+		cfg.Tags[1] = "x"
+		cfg.Tags[#cfg.Tags + 1] = "c"
+		assert(#cfg.Tags == 3)
+		assert(cfg.Labels["env"] == "dev")
+		cfg.Labels.region = "eu"
+		cfg.Ports[2] = 443
+		assert(cfg.Max > 0 and cfg.Max == copy.Max)
+	`)
+	if err != nil {
+		t.Fatalf("Proxy access failed: %v", err)
+	}
+
+	if LUA_VERSION_NUM >= 502 {
+		err = L.DoString(`
+			local n = 0
+			for k, v in pairs(cfg.Labels) do n = n + 1 end
+			assert(n == 2)
+			local s = ""
+			for i, v in ipairs(cfg.Tags) do s = s .. v end
+			assert(s == "xbc")
+		`)
+		if err != nil {
+			t.Fatalf("Iteration over proxies failed: %v", err)
+		}
+	}
+
+	if cfg.Limits.MaxConns != 10 || strings.Join(cfg.Tags, ",") != "x,b,c" || cfg.Labels["region"] != "eu" || cfg.Ports[1] != 443 {
+		t.Fatalf("Assignments through proxies not visible: %#v", cfg)
+	}
+
+	if err := L.DoString(`cfg.Tags[10] = "z"`); err == nil {
+		t.Fatal("Out of range assignment did not fail")
+	}
+
+	// map elements can't be modified in place, only replaced
+	if err := L.DoString(`assert(cfg.Nodes.a.MaxConns == 1); cfg.Nodes.a.MaxConns = 5`); err == nil {
+		t.Fatal("Assignment to a field of a map element did not fail")
+	}
+	if err := L.DoString(`cfg.Nodes.a = { MaxConns = 5 }`); err != nil {
+		t.Fatalf("Assignment of a map element failed: %v", err)
+	}
+	if cfg.Nodes["a"].MaxConns != 5 {
+		t.Fatalf("Assignment of a map element not visible: %#v", cfg.Nodes)
+	}
+}
+
+func TestGoStructTags(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	L.OpenLibs()
+
+	type Owner struct {
+		Name string
+	}
+	type Account struct {
+		ID      int          `lua:"id,readonly"`
+		Balance int          `lua:"balance"`
+		Secret  string       `lua:"-"`
+		Owner   Owner        `lua:"owner,readonly"`
+		Counter MethodStruct `lua:"counter,readonly"`
+		Opened  int          `lua:",readonly"`
+	}
+
+	a := &Account{ID: 1, Balance: 10, Secret: "s", Owner: Owner{"bob"}, Counter: MethodStruct{Count: 3}, Opened: 2019}
+	L.PushGoStruct(a)
+	L.SetGlobal("a")
+
+	err := L.DoString(`
+		assert(a.id == 1)
+		assert(a.owner.Name == "bob")
+		assert(select(2, a.counter:Describe("")) == 3)
+		assert(a.opened == 2019)
+		a.balance = 20
+	`)
+	if err != nil {
+		t.Fatalf("Tagged field access failed: %v", err)
+	}
+	if a.Balance != 20 {
+		t.Fatalf("Assignment to renamed field not visible (%d)", a.Balance)
+	}
+
+	for _, code := range []string{`return a.Secret`, `return a.Balance`, `a.id = 2`, `a.owner.Name = "eve"`, `a.counter:Add(1)`, `return a.Opened`, `a.opened = 0`} {
+		if err := L.DoString(code); err == nil {
+			t.Fatalf("No error executing %q", code)
+		}
+	}
+	if a.ID != 1 || a.Owner.Name != "bob" || a.Counter.Count != 3 || a.Opened != 2019 {
+		t.Fatalf("Read only fields were modified: %#v", a)
+	}
+}
+
+func TestGoPanicInGoFunction(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	L.OpenLibs()
+
+	L.Register("crash", func(L *State) int {
+		var m map[string]int
+		m["x"] = 1
+		return 0
+	})
+
+	err := L.DoString("crash()")
+	if err == nil {
+		t.Fatal("Panic in go function not reported")
+	}
+	le, ok := err.(*LuaError)
+	if !ok {
+		t.Fatalf("Wrong error type %T", err)
+	}
+	if le.PanicValue() == nil {
+		t.Fatal("Panic value not recorded")
+	}
+	if !strings.Contains(string(le.GoStackTrace()), "TestGoPanicInGoFunction") {
+		t.Fatalf("Go stack trace missing: %s", le.GoStackTrace())
+	}
+	if !strings.Contains(le.Error(), "assignment to entry in nil map") {
+		t.Fatalf("Wrong error message: %v", le)
+	}
+
+	// the state is still usable and the error can be caught by lua
+	err = L.DoString(`
+		local ok, msg = unsafe_pcall(crash)
+		assert(not ok and msg:find("nil map"))
+	`)
+	if err != nil {
+		t.Fatalf("Go panic could not be caught from lua: %v", err)
+	}
+}
+
+var errNotFound = errors.New("not found")
+
+type codeError struct {
+	code int
+}
+
+func (e *codeError) Error() string {
+	return fmt.Sprintf("code %d", e.code)
+}
+
+func TestErrorValues(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	L.OpenLibs()
+
+	err := L.DoString(`error({code = 404})`)
+	le, ok := err.(*LuaError)
+	if !ok {
+		t.Fatalf("Wrong error type %T", err)
+	}
+	m, ok := le.Value().(map[string]interface{})
+	if !ok || m["code"] != int64(404) {
+		t.Fatalf("Error value not preserved: %#v", le.Value())
+	}
+	if le.Error() == "" {
+		t.Fatal("Empty error message for table error value")
+	}
+
+	err = L.DoString(`error(setmetatable({}, { __tostring = function() return "custom" end }))`)
+	if err == nil || err.Error() != "custom" {
+		t.Fatalf("__tostring not used for error message: %v", err)
+	}
+
+	L.RegisterFunc("lookup", func() error { return fmt.Errorf("lookup: %w", errNotFound) })
+	L.Register("fail", func(L *State) int {
+		L.RaiseGoError(&codeError{500})
+		return 0
+	})
+
+	err = L.DoString(`lookup()`)
+	if !errors.Is(err, errNotFound) {
+		t.Fatalf("Go error chain lost: %v", err)
+	}
+
+	err = L.DoString(`local x = 1; fail()`)
+	var ce *codeError
+	if !errors.As(err, &ce) || ce.code != 500 {
+		t.Fatalf("Go error not reachable with errors.As: %v", err)
+	}
+}
+
+func TestTraceback(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	L.OpenLibs()
+	L.SetStackTraceLocals(true)
+
+	L.Register("fail", func(L *State) int {
+		L.RaiseError("failed")
+		return 0
+	})
+
+	err := L.DoString(`
+local function inner(x)
+	local y = x * 2
+	fail()
+end
+inner(21)`)
+	le, ok := err.(*LuaError)
+	if !ok {
+		t.Fatalf("Wrong error type %T", err)
+	}
+
+	st := le.StackTrace()
+	if len(st) != 3 {
+		t.Fatalf("Wrong size of stack trace: %v", st)
+	}
+	if st[0].What != "Go" || !strings.Contains(st[0].GoFunction, "TestTraceback") {
+		t.Fatalf("Go frame not recognised: %+v", st[0])
+	}
+	if e := st[1]; e.What != "Lua" || e.Name != "inner" || e.NameWhat != "local" || e.LineDefined != 2 || e.LastLineDefined != 5 || e.CurrentLine != 4 {
+		t.Fatalf("Wrong lua frame: %+v", e)
+	}
+	if st[2].What != "main" {
+		t.Fatalf("Wrong main frame: %+v", st[2])
+	}
+
+	locals := map[string]string{}
+	for _, l := range st[1].Locals {
+		locals[l.Name] = l.Value
+	}
+	if locals["x"] != "21" || locals["y"] != "42" {
+		t.Fatalf("Wrong locals: %+v", st[1].Locals)
+	}
+
+	tb := le.Traceback()
+	for _, s := range []string{"failed\nstack traceback:", "[Go]:", "in function 'inner'", "y = 42", "in main chunk"} {
+		if !strings.Contains(tb, s) {
+			t.Fatalf("Traceback misses %q:\n%s", s, tb)
+		}
+	}
+}
+
+func TestSyntaxError(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	L.OpenLibs()
+
+	err := L.DoString("x = = 1")
+	se, ok := err.(*SyntaxError)
+	if !ok {
+		t.Fatalf("Wrong error type %T (%v)", err, err)
+	}
+	if se.Chunk != `[string "x = = 1"]` || se.Line != 1 || se.Near != "=" || se.Message != "unexpected symbol" {
+		t.Fatalf("Wrong syntax error: %+v", se)
+	}
+
+	err = L.DoString("local function f()\n\treturn 1\n")
+	se, ok = err.(*SyntaxError)
+	if !ok {
+		t.Fatalf("Wrong error type %T (%v)", err, err)
+	}
+	if se.Line != 3 || se.Near != "<eof>" || !strings.HasPrefix(se.Message, "'end' expected") {
+		t.Fatalf("Wrong syntax error: %+v", se)
+	}
+	if se.Error() == "" {
+		t.Fatal("Empty syntax error message")
+	}
+
+	if r := L.Load([]byte("return )"), "=config"); r != LUA_ERRSYNTAX {
+		t.Fatalf("Wrong result from Load: %d", r)
+	}
+	se, ok = L.LoadError(LUA_ERRSYNTAX).(*SyntaxError)
+	if !ok || se.Chunk != "config" || se.Line != 1 || se.Near != ")" {
+		t.Fatalf("Wrong syntax error from Load: %+v", se)
+	}
+}
+
+func TestDoStringContext(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	L.OpenLibs()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := L.DoStringContext(ctx, `while true do end`)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected a deadline error, got %v", err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	err = L.DoStringContext(ctx, `local i = 0; while true do i = i + 1 end`)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected a cancellation error, got %v", err)
+	}
+
+	// a done context stops the code before it runs
+	if err := L.DoStringContext(ctx, `done = true`); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected a cancellation error, got %v", err)
+	}
+	L.GetGlobal("done")
+	if L.ToBoolean(-1) {
+		t.Fatal("Code ran with a cancelled context")
+	}
+	L.Pop(1)
+
+	if err := L.DoStringContext(context.Background(), `x = 1`); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// coroutines created before the context is done are interrupted too
+	for _, code := range []string{
+		`coroutine.wrap(function() while true do end end)()`,
+		`local co = coroutine.create(function() while true do end end)
+		assert(coroutine.resume(co))`,
+	} {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		err := L.DoStringContext(ctx, code)
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("Expected a deadline error running %q, got %v", code, err)
+		}
+	}
+}
+
+func TestCallContextWithHook(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	L.OpenLibs()
+
+	hooks := 0
+	L.SetHook(func(L *State) { hooks++ }, 100)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	L.MustDoString(`function spin(n) for i = 1, n do end end`)
+	L.GetGlobal("spin")
+	L.PushInteger(1 << 40)
+	err := L.CallContext(ctx, 1, 0)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected a deadline error, got %v", err)
+	}
+	if hooks == 0 {
+		t.Fatal("User hook not called during CallContext")
+	}
+
+	// the user hook is back in place
+	hooks = 0
+	if err := L.DoString(`spin(10000)`); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if hooks == 0 {
+		t.Fatal("User hook not restored after CallContext")
+	}
+}
+
+func TestHooks(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	L.OpenLibs()
+
+	L.MustDoString(`
+function add(a, b)
+	local c = a + b
+	return c
+end`)
+
+	var calls, returns []string
+	lines := map[int]bool{}
+	id := L.AddHook(LUA_MASKCALL|LUA_MASKRET|LUA_MASKLINE, 0, func(L *State, info *HookInfo) {
+		switch info.Event {
+		case LUA_HOOKCALL:
+			calls = append(calls, info.Name)
+		case LUA_HOOKRET:
+			returns = append(returns, info.Name)
+		case LUA_HOOKLINE:
+			if info.What == "Lua" {
+				lines[info.CurrentLine] = true
+			}
+		}
+	})
+
+	L.GetGlobal("add")
+	L.PushInteger(1)
+	L.PushInteger(2)
+	if err := L.Call(2, 1); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	L.Pop(1)
+
+	if len(calls) != 1 || calls[0] != "" && calls[0] != "add" {
+		t.Fatalf("Wrong call events: %v", calls)
+	}
+	if len(returns) != 1 {
+		t.Fatalf("Wrong return events: %v", returns)
+	}
+	if !lines[3] || !lines[4] {
+		t.Fatalf("Wrong line events: %v", lines)
+	}
+
+	L.RemoveHook(id)
+	calls = nil
+	L.MustDoString(`add(1, 2)`)
+	if len(calls) != 0 {
+		t.Fatalf("Hook called after RemoveHook: %v", calls)
+	}
+}
+
+func TestHookAndExecutionLimit(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	L.OpenLibs()
+
+	hooks := 0
+	L.SetHook(func(L *State) { hooks++ }, 100)
+	L.SetExecutionLimit(100000)
+
+	err := L.DoString(`while true do end`)
+	if err == nil || !strings.Contains(err.Error(), ExecutionQuantumExceeded) {
+		t.Fatalf("Execution limit not enforced: %v", err)
+	}
+	if hooks < 900 {
+		t.Fatalf("SetHook hook replaced by SetExecutionLimit (%d calls)", hooks)
+	}
+
+	L.SetHook(nil, 0)
+	hooks = 0
+	if err := L.DoString(`while true do end`); err == nil {
+		t.Fatal("Execution limit removed by SetHook")
+	}
+	if hooks != 0 {
+		t.Fatalf("Hook still called after SetHook(nil, 0): %d", hooks)
+	}
+}
+
+func TestMemoryLimit(t *testing.T) {
+	L := NewStateWithMemoryLimit(1 << 20)
+	if L == nil {
+		t.Skip("custom allocators not supported")
+	}
+	defer L.Close()
+	L.OpenLibs()
+
+	if L.MemoryLimit() != 1<<20 {
+		t.Fatalf("Wrong memory limit: %d", L.MemoryLimit())
+	}
+	if L.MemoryUsage() == 0 || L.MemoryUsage() > L.MemoryPeak() {
+		t.Fatalf("Wrong memory accounting: usage %d, peak %d", L.MemoryUsage(), L.MemoryPeak())
+	}
+
+	err := L.DoString(`local s = string.rep("x", 2 * 1024 * 1024)`)
+	le, ok := err.(*LuaError)
+	if !ok || le.Code() != LUA_ERRMEM {
+		t.Fatalf("Expected a memory error, got %v", err)
+	}
+	if L.MemoryPeak() > 1<<20 {
+		t.Fatalf("Memory limit exceeded: peak %d", L.MemoryPeak())
+	}
+
+	L.SetMemoryLimit(8 << 20)
+	if err := L.DoString(`local s = string.rep("x", 2 * 1024 * 1024)`); err != nil {
+		t.Fatalf("Unexpected error after raising the limit: %v", err)
+	}
+	if L.MemoryPeak() < 2<<20 {
+		t.Fatalf("Peak not updated: %d", L.MemoryPeak())
+	}
+}
+
+func TestCPUProfile(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	L.OpenLibs()
+
+	L.Register("work", func(L *State) int {
+		time.Sleep(time.Millisecond)
+		return 0
+	})
+
+	var buf bytes.Buffer
+	if err := L.StartCPUProfile(&buf); err != nil {
+		t.Fatalf("StartCPUProfile: %v", err)
+	}
+	if err := L.StartCPUProfile(&buf); err == nil {
+		t.Fatal("Second StartCPUProfile didn't fail")
+	}
+	L.MustDoString(`
+function hot(n)
+	local x = 0
+	for i = 1, n do x = x + i end
+	work()
+	return x
+end
+for i = 1, 10 do hot(100000) end`)
+	if err := L.StopCPUProfile(); err != nil {
+		t.Fatalf("StopCPUProfile: %v", err)
+	}
+
+	zr, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatalf("Profile is not gzipped: %v", err)
+	}
+	data, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("Reading profile: %v", err)
+	}
+	for _, s := range []string{"hot", "main chunk", "TestCPUProfile", "nanoseconds"} {
+		if !bytes.Contains(data, []byte(s)) {
+			t.Fatalf("Profile misses %q", s)
+		}
+	}
+
+	// the time spent outside of lua isn't charged to the next sample
+	buf.Reset()
+	if err := L.StartCPUProfile(&buf); err != nil {
+		t.Fatalf("StartCPUProfile: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	L.MustDoString(`hot(10)`)
+	var total int64
+	for _, s := range L.profiler.samples {
+		total += s.nanos
+	}
+	if total >= int64(50*time.Millisecond) {
+		t.Fatalf("Idle time charged to the profile: %v", time.Duration(total))
+	}
+	for _, fr := range L.profiler.locationList {
+		if fr.line < 0 || fr.function.start < 0 {
+			t.Fatalf("Negative line in the profile: %+v", fr)
+		}
+	}
+	if err := L.StopCPUProfile(); err != nil {
+		t.Fatalf("StopCPUProfile: %v", err)
+	}
+}
+
+const coverageScript = `
+function covered(x)
+	if x then
+		return 1
+	end
+	return 2
+end
+`
+
+func runCovered(t *testing.T, c *Coverage, arg bool) {
+	L := NewState()
+	defer L.Close()
+	L.OpenLibs()
+	L.StartCoverage(c)
+	if r := L.Load([]byte(coverageScript), "=rules.lua"); r != 0 {
+		t.Fatalf("Load: %v", L.LoadError(r))
+	}
+	if err := L.Call(0, 0); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	L.GetGlobal("covered")
+	L.PushBoolean(arg)
+	if err := L.Call(1, 0); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	L.StopCoverage()
+	// not recorded
+	L.MustDoString("covered(true)")
+}
+
+func TestCoverage(t *testing.T) {
+	c := NewCoverage()
+	runCovered(t, c, true)
+
+	lines := c.Lines("rules.lua")
+	if lines[3] != 1 || lines[4] != 1 {
+		t.Fatalf("Executed lines not recorded: %v", lines)
+	}
+	if n, ok := lines[6]; !ok || n != 0 {
+		t.Fatalf("Missed line not recorded: %v", lines)
+	}
+	if p := c.Percent(); p <= 0 || p >= 100 {
+		t.Fatalf("Wrong coverage percentage: %v", p)
+	}
+
+	var lcov bytes.Buffer
+	if err := c.WriteLCOV(&lcov); err != nil {
+		t.Fatalf("WriteLCOV: %v", err)
+	}
+	for _, s := range []string{"SF:rules.lua\n", "DA:4,1\n", "DA:6,0\n", "end_of_record\n"} {
+		if !strings.Contains(lcov.String(), s) {
+			t.Fatalf("LCOV output misses %q:\n%s", s, lcov.String())
+		}
+	}
+
+	other := NewCoverage()
+	runCovered(t, other, false)
+	c.Merge(other)
+	lines = c.Lines("rules.lua")
+	if lines[3] != 2 || lines[6] != 1 {
+		t.Fatalf("Coverage not merged: %v", lines)
+	}
+
+	var text bytes.Buffer
+	if err := c.WriteText(&text); err != nil {
+		t.Fatalf("WriteText: %v", err)
+	}
+	if !strings.Contains(text.String(), "rules.lua") || !strings.Contains(text.String(), "total") {
+		t.Fatalf("Wrong text report:\n%s", text.String())
+	}
+
+	// the lines of functions entered through a tail call are known too
+	L := NewState()
+	defer L.Close()
+	L.OpenLibs()
+	tail := NewCoverage()
+	L.StartCoverage(tail)
+	if r := L.Load([]byte(`local function f(x)
+	if x then
+		return 1
+	end
+	return 2
+end
+return f(true)`), "=tail.lua"); r != 0 {
+		t.Fatalf("Load: %v", L.LoadError(r))
+	}
+	if err := L.Call(0, 0); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	L.StopCoverage()
+	if n, ok := tail.Lines("tail.lua")[5]; !ok || n != 0 {
+		t.Fatalf("Missed line of a tail called function not recorded: %v", tail.Lines("tail.lua"))
+	}
+}
+
+type dapClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+	seq  int
+}
+
+func (c *dapClient) request(command string, args interface{}) map[string]interface{} {
+	c.seq++
+	data, _ := json.Marshal(map[string]interface{}{"seq": c.seq, "type": "request", "command": command, "arguments": args})
+	fmt.Fprintf(c.conn, "Content-Length: %d\r\n\r\n%s", len(data), data)
+	for {
+		msg := c.read()
+		if msg["type"] == "response" && msg["request_seq"] == float64(c.seq) {
+			if msg["success"] != true {
+				c.t.Errorf("%s failed: %v", command, msg["message"])
+			}
+			body, _ := msg["body"].(map[string]interface{})
+			return body
+		}
+	}
+}
+
+func (c *dapClient) waitEvent(event string) map[string]interface{} {
+	for {
+		msg := c.read()
+		if msg["type"] == "event" && msg["event"] == event {
+			body, _ := msg["body"].(map[string]interface{})
+			return body
+		}
+	}
+}
+
+// Reads a message, the client is also used outside of the test goroutine
+// so failures end the calling goroutine with runtime.Goexit
+func (c *dapClient) read() map[string]interface{} {
+	header, err := textproto.NewReader(c.r).ReadMIMEHeader()
+	if err != nil {
+		c.t.Errorf("Reading DAP header: %v", err)
+		runtime.Goexit()
+	}
+	n, _ := strconv.Atoi(header.Get("Content-Length"))
+	data := make([]byte, n)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		c.t.Errorf("Reading DAP message: %v", err)
+		runtime.Goexit()
+	}
+	var msg map[string]interface{}
+	if err := json.Unmarshal(data, &msg); err != nil {
+		c.t.Errorf("Decoding DAP message: %v", err)
+		runtime.Goexit()
+	}
+	return msg
+}
+
+func TestDebuggerDAP(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	L.OpenLibs()
+
+	d := NewDebugger(L)
+	defer d.Close()
+	l, err := d.ListenDAP("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenDAP: %v", err)
+	}
+	defer l.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	c := &dapClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+
+	c.request("initialize", map[string]interface{}{"adapterID": "lua"})
+	c.waitEvent("initialized")
+	c.request("setBreakpoints", map[string]interface{}{
+		"source":      map[string]interface{}{"path": "dbg.lua"},
+		"breakpoints": []map[string]interface{}{{"line": 3}},
+	})
+	c.request("configurationDone", nil)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.waitEvent("stopped")
+
+		st := c.request("stackTrace", map[string]interface{}{"threadId": 1})
+		frames, _ := st["stackFrames"].([]interface{})
+		if len(frames) < 2 {
+			t.Errorf("Wrong stack: %v", st)
+			return
+		}
+		top := frames[0].(map[string]interface{})
+		if top["name"] != "add" || top["line"] != float64(3) {
+			t.Errorf("Wrong top frame: %v", top)
+		}
+
+		scopes := c.request("scopes", map[string]interface{}{"frameId": 1})["scopes"].([]interface{})
+		locals := scopes[0].(map[string]interface{})
+		vars := c.request("variables", map[string]interface{}{"variablesReference": locals["variablesReference"]})["variables"].([]interface{})
+		values := map[string]interface{}{}
+		for _, v := range vars {
+			v := v.(map[string]interface{})
+			values[v["name"].(string)] = v["value"]
+		}
+		if values["a"] != "20" || values["sum"] != "21" {
+			t.Errorf("Wrong locals: %v", values)
+		}
+
+		res := c.request("evaluate", map[string]interface{}{"expression": "sum * 2", "frameId": 1})
+		if res["result"] != "42" {
+			t.Errorf("Wrong evaluation: %v", res)
+		}
+
+		c.request("continue", map[string]interface{}{"threadId": 1})
+	}()
+
+	if r := L.Load([]byte("local function add(a, b)\n\tlocal sum = a + b\n\treturn sum\nend\nlocal x = 20\nresult = add(x, 1)\n"), "@dbg.lua"); r != 0 {
+		t.Fatalf("Load: %v", L.LoadError(r))
+	}
+	if err := L.Call(0, 0); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	<-done
+
+	L.GetGlobal("result")
+	if L.ToInteger(-1) != 21 {
+		t.Fatalf("Wrong result: %v", L.ToInteger(-1))
+	}
+	L.Pop(1)
+
+	c.request("disconnect", nil)
+}
+
+func TestDebuggerCoroutine(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	L.OpenLibs()
+
+	d := NewDebugger(L)
+	defer d.Close()
+	d.SetBreakpoints("co.lua", []int{3})
+
+	if r := L.Load([]byte("local co = coroutine.wrap(function(n)\n\tlocal inner = n * 2\n\treturn inner\nend)\nresult = co(21)\n"), "@co.lua"); r != 0 {
+		t.Fatalf("Load: %v", L.LoadError(r))
+	}
+	done := make(chan error)
+	go func() { done <- L.Call(0, 0) }()
+
+	for !d.Stopped() {
+		time.Sleep(time.Millisecond)
+	}
+	// the stack and the variables are those of the coroutine
+	st, err := d.StackTrace()
+	if err != nil || len(st) != 1 || st[0].CurrentLine != 3 {
+		t.Fatalf("Wrong stack: %v, %v", st, err)
+	}
+	scopes, err := d.Scopes(0)
+	if err != nil {
+		t.Fatalf("Scopes: %v", err)
+	}
+	vars, err := d.Variables(scopes[0].Reference)
+	if err != nil || len(vars) != 2 || vars[0].Value != "21" || vars[1].Value != "42" {
+		t.Fatalf("Wrong locals: %v, %v", vars, err)
+	}
+	if v, err := d.Evaluate(0, "inner + n"); err != nil || v.Value != "63" {
+		t.Fatalf("Wrong evaluation: %v, %v", v, err)
+	}
+
+	// no other line of the coroutine, stepping over runs until the end
+	d.StepOver()
+	if err := <-done; err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	L.GetGlobal("result")
+	if L.ToInteger(-1) != 42 {
+		t.Fatalf("Wrong result: %v", L.ToInteger(-1))
+	}
+	L.Pop(1)
+}
+
+func TestSandboxState(t *testing.T) {
+	L := NewSandboxState(SandboxOptions{})
+	defer L.Close()
+
+	err := L.DoString(`
+		assert(io == nil and require == nil and dofile == nil and debug == nil)
+		assert(os.execute == nil and os.time ~= nil)
+		assert(string.dump == nil and ("").dump == nil)
+		assert(getmetatable("") == false)
+		assert(string.format("%d", math.floor(2.5)) == "2")
+		assert(("abc"):upper() == "ABC")
+	`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// errors keep their message and stack trace
+	err = L.DoString(`error("x")`)
+	if le, ok := err.(*LuaError); !ok || le.Code() != LUA_ERRRUN || !strings.HasSuffix(le.Error(), ": x") || len(le.StackTrace()) == 0 {
+		t.Fatalf("Wrong error: %v", err)
+	}
+
+	L2 := NewSandboxState(SandboxOptions{Allow: append([]string{"load"}, DefaultSandboxAllowlist...)})
+	defer L2.Close()
+	err = L2.DoString(`
+		local f, err = load("\27Lua")
+		assert(f == nil and err:find("binary"))
+		f = load("return x", "chunk", "t", {x = 42})
+		assert(f() == 42)
+	`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	L3 := NewSandboxState(SandboxOptions{InstructionLimit: 1000})
+	defer L3.Close()
+	err = L3.DoString(`while true do end`)
+	if err == nil || !strings.Contains(err.Error(), ExecutionQuantumExceeded) {
+		t.Fatalf("Expected the instruction limit to be hit, got %v", err)
+	}
+
+	L4 := NewSandboxState(SandboxOptions{MemoryLimit: 1 << 20})
+	if L4 == nil {
+		t.Skip("custom allocators not supported")
+	}
+	defer L4.Close()
+	err = L4.DoString(`local s = string.rep("x", 2 * 1024 * 1024)`)
+	if le, ok := err.(*LuaError); !ok || le.Code() != LUA_ERRMEM {
+		t.Fatalf("Expected a memory error, got %v", err)
+	}
+
+	// too low for the setup, which must not run out of memory
+	if L5 := NewSandboxState(SandboxOptions{MemoryLimit: 4096}); L5 != nil {
+		L5.Close()
+		t.Fatalf("Expected no state with a limit of 4KB")
+	}
+}
+
+func TestCoroutine(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	L.OpenLibs()
+
+	var co *Coroutine
+	var inside *State
+	var status CoroutineStatus
+	L.Register("double", func(L *State) int {
+		inside = L
+		if co != nil {
+			status = co.Status()
+		}
+		L.PushInteger(int64(2 * L.ToInteger(1)))
+		return 1
+	})
+
+	if err := L.DoString(`
+		function gen(n)
+			for i = 1, n do
+				coroutine.yield(double(i), "x")
+			end
+			return "end"
+		end
+	`); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	L.GetGlobal("gen")
+	co, err := L.NewCoroutine()
+	if err != nil {
+		t.Fatalf("NewCoroutine: %v", err)
+	}
+	defer co.Close()
+	if L.GetTop() != 0 {
+		t.Fatalf("Stack not empty: %d", L.GetTop())
+	}
+	if co.Status() != CoroutineSuspended {
+		t.Fatalf("Wrong initial status: %v", co.Status())
+	}
+
+	for i := 1; i <= 2; i++ {
+		var args []interface{}
+		if i == 1 {
+			args = []interface{}{2}
+		}
+		res, done, err := co.Resume(args...)
+		if err != nil || done {
+			t.Fatalf("Resume %d: done %v, error %v", i, done, err)
+		}
+		if len(res) != 2 || res[0] != int64(2*i) || res[1] != "x" {
+			t.Fatalf("Wrong results of resume %d: %v", i, res)
+		}
+		if inside != co.Thread() || status != CoroutineRunning {
+			t.Fatalf("Go function ran on %p with status %v, expected %p", inside, status, co.Thread())
+		}
+		if co.Status() != CoroutineSuspended {
+			t.Fatalf("Wrong status after yield: %v", co.Status())
+		}
+	}
+
+	res, done, err := co.Resume()
+	if err != nil || !done || len(res) != 1 || res[0] != "end" {
+		t.Fatalf("Wrong end of coroutine: %v %v %v", res, done, err)
+	}
+	if co.Status() != CoroutineDead {
+		t.Fatalf("Wrong final status: %v", co.Status())
+	}
+	if _, _, err := co.Resume(); err != ErrCoroutineDead {
+		t.Fatalf("Expected ErrCoroutineDead, got %v", err)
+	}
+
+	// errors end the coroutine
+	L.DoString(`return function() double(1); error("boom") end`)
+	co2, _ := L.NewCoroutine()
+	defer co2.Close()
+	if _, done, err := co2.Resume(); err == nil || !done || !strings.Contains(err.Error(), "boom") {
+		t.Fatalf("Expected the error of the coroutine, got %v", err)
+	}
+
+	// go errors whose message changed on the way out aren't kept
+	L.Register("fail", func(L *State) int {
+		L.RaiseGoError(errNotFound)
+		return 0
+	})
+	L.DoString(`return function() coroutine.wrap(function() fail() end)() end`)
+	co3, _ := L.NewCoroutine()
+	defer co3.Close()
+	if _, _, err := co3.Resume(); err == nil || len(co3.Thread().goErrors) != 0 {
+		t.Fatalf("Expected an error and no pending go errors, got %v, %d", err, len(co3.Thread().goErrors))
+	}
+
+	// coroutines created by lua get their own State too
+	co = nil
+	if err := L.DoString(`
+		local co = coroutine.create(function() return double(21) end)
+		thread = co
+		local ok, v = coroutine.resume(co)
+		assert(ok and v == 42)
+	`); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	L.GetGlobal("thread")
+	if T := L.ToThread(-1); T == nil || T != inside || T == L {
+		t.Fatalf("ToThread returned %p, the go function ran on %p", T, inside)
+	}
+	L.Pop(1)
+}
+
+func TestAwaitArguments(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	L.OpenLibs()
+
+	// the arguments of the go function can't be converted to go values,
+	// they must not be taken for the yielded values
+	L.Register("call", func(L *State) int {
+		return L.Await(Async(func() ([]interface{}, error) {
+			return []interface{}{"done"}, nil
+		}))
+	})
+	if err := L.DoString(`
+		function job()
+			local v = call(function() end, {f = print})
+			return v, call(print)
+		end
+	`); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	L.GetGlobal("job")
+	co, err := L.NewCoroutine()
+	if err != nil {
+		t.Fatalf("NewCoroutine: %v", err)
+	}
+	defer co.Close()
+	for i := 0; i < 2; i++ {
+		res, done, err := co.Resume()
+		if err != nil || done || len(res) != 0 || co.Future() == nil {
+			t.Fatalf("Resume %d: %v, %v, %v", i, res, done, err)
+		}
+	}
+	res, done, err := co.Resume()
+	if err != nil || !done || len(res) != 2 || res[0] != "done" || res[1] != "done" {
+		t.Fatalf("Wrong end of coroutine: %v, %v, %v", res, done, err)
+	}
+
+	s := NewScheduler(L)
+	L.GetGlobal("job")
+	task, err := s.Spawn()
+	if err != nil {
+		t.Fatalf("Spawn: %v", err)
+	}
+	if err := s.Run(context.Background()); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if res, err := task.Result(); err != nil || len(res) != 2 || res[0] != "done" || res[1] != "done" {
+		t.Fatalf("Wrong result of task: %v, %v", res, err)
+	}
+
+	// an Await that can't yield leaves no future behind
+	if err := L.DoString(`
+		return function()
+			assert(not pcall(table.sort, {1, 2}, function(a, b) call() return a < b end))
+			coroutine.yield("x")
+		end
+	`); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	co2, err := L.NewCoroutine()
+	if err != nil {
+		t.Fatalf("NewCoroutine: %v", err)
+	}
+	defer co2.Close()
+	res, done, err = co2.Resume()
+	if err != nil || done || len(res) != 1 || res[0] != "x" || co2.Future() != nil {
+		t.Fatalf("Wrong yield after a failed Await: %v, %v, %v, %v", res, done, err, co2.Future())
+	}
+	if err := L.DoString(`call()`); err == nil {
+		t.Fatalf("Expected an error awaiting outside of a coroutine")
+	}
+	if L.awaiting != nil {
+		t.Fatalf("Future left after a failed Await")
+	}
+}
+
+func TestScheduler(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	L.OpenLibs()
+
+	release := make(chan struct{})
+	L.Register("fetch", func(L *State) int {
+		key := L.ToString(1)
+		return L.Await(Async(func() ([]interface{}, error) {
+			<-release
+			if key == "bad" {
+				return nil, errNotFound
+			}
+			return []interface{}{key + "!", len(key)}, nil
+		}))
+	})
+
+	if err := L.DoString(`
+		function job(key)
+			local v, n = fetch(key)
+			coroutine.yield()
+			return v, n
+		end
+	`); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	s := NewScheduler(L)
+	var tasks []*Task
+	for _, key := range []string{"a", "bb", "bad"} {
+		L.GetGlobal("job")
+		task, err := s.Spawn(key)
+		if err != nil {
+			t.Fatalf("Spawn: %v", err)
+		}
+		tasks = append(tasks, task)
+	}
+
+	// every coroutine waits for its future at the same time
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	err := s.Run(ctx)
+	cancel()
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Expected the deadline to be exceeded, got %v", err)
+	}
+	for _, task := range tasks {
+		if task.Done() {
+			t.Fatalf("Task finished before its future")
+		}
+	}
+
+	close(release)
+	if err := s.Run(context.Background()); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	for i, want := range [][]interface{}{{"a!", int64(1)}, {"bb!", int64(2)}} {
+		res, err := tasks[i].Result()
+		if !tasks[i].Done() || err != nil || len(res) != 2 || res[0] != want[0] || res[1] != want[1] {
+			t.Fatalf("Wrong result of task %d: %v, %v", i, res, err)
+		}
+	}
+
+	res, err := tasks[2].Result()
+	if yieldContinuations {
+		if err == nil || !errors.Is(err, errNotFound) {
+			t.Fatalf("Expected the error of the future, got %v, %v", res, err)
+		}
+	} else if err != nil || len(res) != 2 || res[0] != nil || res[1] != errNotFound.Error() {
+		t.Fatalf("Expected nil and the error message, got %v, %v", res, err)
+	}
+}
+
+func TestSafeState(t *testing.T) {
+	s, err := NewSafeState(4, nil)
+	if err != nil {
+		t.Fatalf("NewSafeState: %v", err)
+	}
+
+	if _, err := s.Eval(context.Background(), `
+		count = 0
+		calc = {}
+		function calc.add(a, b) count = count + 1; return a + b, "sum" end
+	`); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	const workers = 8
+	errs := make(chan error, workers)
+	for i := 0; i < workers; i++ {
+		go func(i int) {
+			res, err := s.Call(context.Background(), "calc.add", i, 1)
+			if err == nil && (len(res) != 2 || res[0] != int64(i+1) || res[1] != "sum") {
+				err = fmt.Errorf("wrong results %v", res)
+			}
+			errs <- err
+		}(i)
+	}
+	for i := 0; i < workers; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("Call: %v", err)
+		}
+	}
+
+	res, err := s.Eval(context.Background(), `return count`)
+	if err != nil || len(res) != 1 || res[0] != int64(workers) {
+		t.Fatalf("Wrong count: %v, %v", res, err)
+	}
+
+	if _, err := s.Call(context.Background(), "calc.missing"); err == nil {
+		t.Fatalf("Expected an error calling a missing function")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	_, err = s.Eval(ctx, `while true do end`)
+	cancel()
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected the deadline to be exceeded, got %v", err)
+	}
+
+	err = s.Do(func(L *State) error {
+		L.PushString("left on the stack")
+		panic("boom")
+	})
+	if err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Fatalf("Expected the panic as an error, got %v", err)
+	}
+	s.Do(func(L *State) error {
+		if L.GetTop() != 0 {
+			t.Errorf("Stack not emptied: %d", L.GetTop())
+		}
+		return nil
+	})
+
+	s.Close()
+	if err := s.Do(func(L *State) error { return nil }); err != ErrSafeStateClosed {
+		t.Fatalf("Expected ErrSafeStateClosed, got %v", err)
+	}
+}
+
+func TestPool(t *testing.T) {
+	inits := 0
+	p := NewPool(PoolOptions{
+		Init: func(L *State) error {
+			inits++
+			return L.DoString(`rules = {limit = 10}`)
+		},
+		MaxSize:   1,
+		MaxErrors: 1,
+	})
+	defer p.Close()
+
+	L, err := p.Get(context.Background())
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if err := L.DoString(`
+		x = 1
+		rules.limit = 20
+		rules.extra = {}
+		string.shout = string.upper
+	`); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// the pool is full
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	if _, err := p.Get(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Expected the deadline to be exceeded, got %v", err)
+	}
+	cancel()
+
+	got := make(chan *State)
+	go func() {
+		L, err := p.Get(context.Background())
+		if err != nil {
+			t.Errorf("Get: %v", err)
+		}
+		got <- L
+	}()
+	// the Get above waited once
+	for p.Stats().Waits < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	p.Put(L)
+	L2 := <-got
+	if L2 != L || inits != 1 {
+		t.Fatalf("State not reused: %p %p, %d inits", L, L2, inits)
+	}
+	if err := L2.DoString(`
+		assert(x == nil)
+		assert(rules.limit == 10 and rules.extra == nil)
+		assert(string.shout == nil and string.upper ~= nil)
+	`); err != nil {
+		t.Fatalf("Globals not restored: %v", err)
+	}
+
+	// too many errors
+	L2.DoString(`error("one")`)
+	L2.DoString(`error("two")`)
+	p.Put(L2)
+	if s := p.Stats(); s.Size != 0 || s.Idle != 0 || s.Evictions != 1 || s.Created != 1 || s.Waits != 2 {
+		t.Fatalf("Wrong stats: %+v", s)
+	}
+
+	L3, err := p.Get(context.Background())
+	if err != nil || L3 == L2 || inits != 2 {
+		t.Fatalf("Expected a new State, got %p (%v), %d inits", L3, err, inits)
+	}
+	p.Put(L3)
+
+	// globals that can't be snapshotted
+	deep := NewPool(PoolOptions{
+		Init: func(L *State) error {
+			return L.DoString(`local t = _G; for i = 1, 1000000 do t.next = {}; t = t.next end`)
+		},
+	})
+	defer deep.Close()
+	if _, err := deep.Get(context.Background()); err == nil {
+		t.Fatal("Expected an error for tables nested too deeply")
+	}
+	if s := deep.Stats(); s.Size != 0 {
+		t.Fatalf("Wrong stats: %+v", s)
+	}
+}
+
+func TestRegisterModule(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+
+	if err := L.RegisterModule("mymod", nil); err == nil {
+		t.Fatalf("Expected an error without the package library")
+	}
+
+	L.OpenLibs()
+	calls := 0
+	err := L.RegisterModule("mymod", map[string]LuaGoFunction{
+		"add": func(L *State) int {
+			calls++
+			L.PushInteger(int64(L.ToInteger(1) + L.ToInteger(2)))
+			return 1
+		},
+	}, map[string]interface{}{"version": "1.0", "limits": []int{1, 2}})
+	if err != nil {
+		t.Fatalf("RegisterModule: %v", err)
+	}
+
+	if err := L.DoString(`
+		assert(mymod == nil and package.loaded.mymod == nil)
+		local m = require "mymod"
+		assert(type(m.add) == "function" and m.add(1, 2) == 3)
+		assert(m.version == "1.0" and m.limits[2] == 2)
+		assert(require("mymod") == m and package.loaded.mymod == m)
+		assert(mymod == nil)
+	`); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if calls != 1 {
+		t.Fatalf("Wrong number of calls: %d", calls)
+	}
+}
+
+func TestStdio(t *testing.T) {
+	L := NewState()
+	defer L.Close()
+	L.OpenLibs()
+
+	var stdout, stderr bytes.Buffer
+	L.SetStdout(&stdout)
+	L.SetStderr(&stderr)
+	L.SetStdin(strings.NewReader("first line\n42 3.5\nsecond\nthird\n"))
+
+	if err := L.DoString(`
+		print("a", 1, nil, true)
+		assert(io.write("b", 2) == io.stdout)
+		io.stdout:write("c\n")
+		assert(io.output() == io.stdout)
+		io.stderr:write("oops")
+		assert(io.read() == "first line")
+		local n, f = io.read("*n", "n")
+		assert(n == 42 and f == 3.5)
+		assert(io.read("L") == "\n")
+		local lines = {}
+		for l in io.lines() do lines[#lines + 1] = l end
+		assert(#lines == 2 and lines[1] == "second" and lines[2] == "third")
+		assert(io.read() == nil and io.read("a") == "")
+		assert(tostring(io.stdin) == "file (stdin)")
+		assert(io.stdin:close() == nil)
+		assert(io.type(io.stdout) == "file" and io.type(io.stdin) == "file")
+		assert(io.type(42) == nil)
+		assert(io.stdout:seek("set") == nil)
+	`); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// numbers are read like lua numerals and stop at the first character
+	// that can't continue one
+	L.SetStdin(strings.NewReader("5abc 3-4 010 0b101 0x1F -0x10 0x1p4 1e2 .5 - 7"))
+	if err := L.DoString(`
+		assert(io.read("n") == 5 and io.read(3) == "abc")
+		assert(io.read("n") == 3 and io.read("n") == -4)
+		assert(io.read("n") == 10)
+		assert(io.read("n") == 0 and io.read(4) == "b101")
+		assert(io.read("n") == 31 and io.read("n") == -16)
+		assert(io.read("n") == 16 and io.read("n") == 100)
+		assert(io.read("n") == 0.5)
+		assert(io.read("n") == nil and io.read("a") == " 7")
+	`); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if s := stdout.String(); s != "a\t1\tnil\ttrue\nb2c\n" {
+		t.Fatalf("Wrong stdout: %q", s)
+	}
+	if s := stderr.String(); s != "oops" {
+		t.Fatalf("Wrong stderr: %q", s)
+	}
+
+	if err := L.DoString(`io.write({})`); err == nil {
+		t.Fatalf("Expected an error writing a table")
+	}
+
+	// other states keep the standard streams of the process
+	L2 := NewState()
+	defer L2.Close()
+	L2.OpenLibs()
+	if err := L2.DoString(`assert(tostring(io.stdout) ~= "file (stdout)")`); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// print isn't given back to a sandbox that doesn't allow it
+	S := NewSandboxState(SandboxOptions{Allow: []string{"assert", "tostring"}})
+	defer S.Close()
+	S.SetStdout(&stdout)
+	if err := S.DoString(`assert(print == nil)`); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// nor does it replace the print of the program
+	L.Register("print", func(L *State) int { return 0 })
+	L.SetStdout(&stdout)
+	stdout.Reset()
+	if err := L.DoString(`print("hidden")`); err != nil || stdout.Len() != 0 {
+		t.Fatalf("Wrong print: %v, %q", err, stdout.String())
+	}
+}
@@ -0,0 +1,55 @@
+package lua
+
+import (
+	"errors"
+)
+
+// Makes the go functions funcs and the values of fields, converted with
+// PushGoValue, available as the module name:
+//
+//	local m = require "name"
+//
+// The table of the module is created by a loader stored in
+// package.preload the first time it is required, and cached in
+// package.loaded like the tables of C modules. No global variable is set.
+// The package library must be open.
+func (L *State) RegisterModule(name string, funcs map[string]LuaGoFunction, fields ...map[string]interface{}) error {
+	module := make(map[string]LuaGoFunction, len(funcs))
+	for k, f := range funcs {
+		module[k] = f
+	}
+	values := make(map[string]interface{})
+	for _, m := range fields {
+		for k, v := range m {
+			values[k] = v
+		}
+	}
+
+	L.GetGlobal("package")
+	if !L.IsTable(-1) {
+		L.Pop(1)
+		return errors.New("lua: RegisterModule needs the package library")
+	}
+	L.GetField(-1, "preload")
+	if !L.IsTable(-1) {
+		L.Pop(2)
+		return errors.New("lua: package.preload is not a table")
+	}
+	L.PushGoClosure(func(L *State) int {
+		L.CreateTable(0, len(module)+len(values))
+		for k, v := range values {
+			if err := L.PushGoValue(v); err != nil {
+				L.RaiseGoError(err)
+			}
+			L.SetField(-2, k)
+		}
+		for k, f := range module {
+			L.PushGoClosure(f)
+			L.SetField(-2, k)
+		}
+		return 1
+	})
+	L.SetField(-2, name)
+	L.Pop(2)
+	return nil
+}
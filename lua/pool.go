@@ -0,0 +1,337 @@
+package lua
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// Returned by Pool.Get once the pool is closed
+var ErrPoolClosed = errors.New("lua: pool closed")
+
+// Configuration of NewPool
+type PoolOptions struct {
+	// Creates a State, NewState followed by OpenLibs when nil
+	New func() *State
+
+	// Prepares a new State, for instance by loading libraries. The
+	// global variables are restored to what they are after Init every
+	// time the State is given back to the pool.
+	Init func(*State) error
+
+	// Maximum number of States, idle or in use, 0 for no limit. Get
+	// waits for a State when the limit is reached.
+	MaxSize int
+
+	// States using more memory than MaxMemory bytes, after a garbage
+	// collection, are closed instead of being reused. 0 for no limit.
+	MaxMemory uint
+
+	// States that returned more than MaxErrors errors from Call and
+	// Coroutine.Resume are closed instead of being reused. 0 for no limit.
+	MaxErrors int
+}
+
+// Counters of a Pool, see Pool.Stats
+type PoolStats struct {
+	// States currently alive, idle or in use
+	Size int
+	// States waiting in the pool
+	Idle int
+	// States created since the pool was created
+	Created int
+	// Calls to Get that had to wait for a State
+	Waits int
+	// States closed by Put for exceeding MaxMemory or MaxErrors
+	Evictions int
+}
+
+// A pool of initialized States that are reused, see NewPool
+type Pool struct {
+	opts PoolOptions
+
+	mu      sync.Mutex
+	idle    []*State
+	states  map[*State]int
+	waiters []chan *State
+	closed  bool
+	stats   PoolStats
+}
+
+// Creates a pool, its States are created by Get when none is idle
+func NewPool(opts PoolOptions) *Pool {
+	if opts.New == nil {
+		opts.New = func() *State {
+			L := NewState()
+			if L != nil {
+				L.OpenLibs()
+			}
+			return L
+		}
+	}
+	return &Pool{opts: opts, states: make(map[*State]int)}
+}
+
+// Returns an idle State, or a new one if the pool isn't full. Otherwise
+// waits until another State is given back with Put or ctx is done.
+func (p *Pool) Get(ctx context.Context) (*State, error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, ErrPoolClosed
+	}
+	if n := len(p.idle); n > 0 {
+		L := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.mu.Unlock()
+		return L, nil
+	}
+	if p.opts.MaxSize <= 0 || p.stats.Size < p.opts.MaxSize {
+		p.stats.Size++
+		p.mu.Unlock()
+		return p.create()
+	}
+	wait := make(chan *State, 1)
+	p.waiters = append(p.waiters, wait)
+	p.stats.Waits++
+	p.mu.Unlock()
+
+	select {
+	case L, ok := <-wait:
+		return p.received(L, ok)
+	case <-ctx.Done():
+	}
+
+	p.mu.Lock()
+	for i, w := range p.waiters {
+		if w == wait {
+			p.waiters = append(p.waiters[:i], p.waiters[i+1:]...)
+			p.mu.Unlock()
+			return nil, ctx.Err()
+		}
+	}
+	p.mu.Unlock()
+	// a State, or the room for one, was handed over in the meantime
+	if L, ok := <-wait; ok {
+		if L != nil {
+			p.Put(L)
+		} else {
+			p.release()
+		}
+	}
+	return nil, ctx.Err()
+}
+
+// Handles what a waiting Get received: a State, nil for the room to
+// create one, or the closing of the pool
+func (p *Pool) received(L *State, ok bool) (*State, error) {
+	if !ok {
+		return nil, ErrPoolClosed
+	}
+	if L == nil {
+		return p.create()
+	}
+	return L, nil
+}
+
+// Creates and initializes a State, its slot is already counted in Size
+func (p *Pool) create() (*State, error) {
+	L := p.opts.New()
+	if L == nil {
+		p.release()
+		return nil, errors.New("lua: could not create a State for the pool")
+	}
+	if p.opts.Init != nil {
+		if err := p.opts.Init(L); err != nil {
+			L.Close()
+			p.release()
+			return nil, err
+		}
+	}
+	L.SetTop(0)
+	ref, err := L.snapshotGlobals()
+	if err != nil {
+		L.Close()
+		p.release()
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.states[L] = ref
+	p.stats.Created++
+	return L, nil
+}
+
+// Frees the slot of a State that was closed, a waiting Get can use it to
+// create a new State
+func (p *Pool) release() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.waiters) > 0 && !p.closed {
+		w := p.waiters[0]
+		p.waiters = p.waiters[1:]
+		w <- nil
+		return
+	}
+	p.stats.Size--
+}
+
+// Gives L back to the pool: the stack is emptied and the global
+// variables, and the tables reachable from them, are restored to their
+// state after Init. L is closed instead if it exceeds MaxMemory or
+// MaxErrors, or if the pool is closed.
+func (p *Pool) Put(L *State) {
+	p.mu.Lock()
+	ref, ok := p.states[L]
+	closed := p.closed
+	p.mu.Unlock()
+	if !ok {
+		panic("lua: Put of a State that doesn't belong to the pool")
+	}
+
+	L.SetTop(0)
+	L.restoreGlobals(ref)
+	evict := p.opts.MaxErrors > 0 && L.errorCount > p.opts.MaxErrors
+	if p.opts.MaxMemory > 0 && !evict {
+		L.GC(LUA_GCCOLLECT, 0)
+		used := uint(L.GC(LUA_GCCOUNT, 0))*1024 + uint(L.GC(LUA_GCCOUNTB, 0))
+		evict = used > p.opts.MaxMemory
+	}
+
+	if evict || closed {
+		p.mu.Lock()
+		delete(p.states, L)
+		if evict {
+			p.stats.Evictions++
+		}
+		p.mu.Unlock()
+		L.Close()
+		p.release()
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.waiters) > 0 {
+		w := p.waiters[0]
+		p.waiters = p.waiters[1:]
+		w <- L
+		return
+	}
+	p.idle = append(p.idle, L)
+}
+
+// Returns the counters of the pool
+func (p *Pool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := p.stats
+	s.Idle = len(p.idle)
+	return s
+}
+
+// Closes the idle States and makes Get fail, the States in use are closed
+// when they are given back
+func (p *Pool) Close() {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.closed = true
+	for _, w := range p.waiters {
+		close(w)
+	}
+	p.waiters = nil
+	for _, L := range idle {
+		delete(p.states, L)
+	}
+	p.stats.Size -= len(idle)
+	p.mu.Unlock()
+
+	for _, L := range idle {
+		L.Close()
+	}
+}
+
+// Records the contents of every table reachable from the global table,
+// returns the registry reference of the snapshot, a table mapping each
+// table to a copy of its fields
+func (L *State) snapshotGlobals() (int, error) {
+	top := L.GetTop()
+	L.NewTable()
+	L.pushGlobalTable()
+	if err := L.snapshotTable(top+1, top+2); err != nil {
+		L.SetTop(top)
+		return LUA_NOREF, err
+	}
+	L.Pop(1)
+	return L.Ref(LUA_REGISTRYINDEX), nil
+}
+
+func (L *State) snapshotTable(snapshots, index int) error {
+	L.PushValue(index)
+	L.RawGet(snapshots)
+	seen := !L.IsNil(-1)
+	L.Pop(1)
+	if seen {
+		return nil
+	}
+	if !L.CheckStack(5) {
+		return errors.New("lua: global tables nested too deeply for the pool")
+	}
+
+	L.NewTable()
+	copyIndex := L.GetTop()
+	L.PushValue(index)
+	L.PushValue(copyIndex)
+	L.RawSet(snapshots)
+
+	L.PushNil()
+	for L.Next(index) != 0 {
+		L.PushValue(-2)
+		L.PushValue(-2)
+		L.RawSet(copyIndex)
+		if L.IsTable(-1) {
+			if err := L.snapshotTable(snapshots, L.GetTop()); err != nil {
+				return err
+			}
+		}
+		L.Pop(1)
+	}
+	L.Pop(1)
+	return nil
+}
+
+// Restores the tables recorded by snapshotGlobals
+func (L *State) restoreGlobals(ref int) {
+	L.RawGeti(LUA_REGISTRYINDEX, ref)
+	snapshots := L.GetTop()
+	L.PushNil()
+	for L.Next(snapshots) != 0 {
+		table, saved := L.GetTop()-1, L.GetTop()
+
+		// fields added since the snapshot, clearing existing fields
+		// during a traversal is allowed
+		L.PushNil()
+		for L.Next(table) != 0 {
+			L.Pop(1)
+			L.PushValue(-1)
+			L.RawGet(saved)
+			if L.IsNil(-1) {
+				L.PushValue(-2)
+				L.PushNil()
+				L.RawSet(table)
+			}
+			L.Pop(1)
+		}
+
+		L.PushNil()
+		for L.Next(saved) != 0 {
+			L.PushValue(-2)
+			L.Insert(-2)
+			L.RawSet(table)
+		}
+		L.Pop(1)
+	}
+	L.Pop(1)
+}
@@ -0,0 +1,297 @@
+package lua
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Number of lua instructions between two samples of the CPU profiler
+const ProfileSampleInstructions = 1000
+
+// Records the CPU profile of a State, see StartCPUProfile
+type profiler struct {
+	L      *State
+	w      io.Writer
+	hookID HookID
+	start  time.Time
+	// end of the time already accounted to a sample
+	last time.Time
+
+	samples   map[string]*profileSample
+	locations map[profileFrame]uint64
+	functions map[profileFunction]uint64
+	strings   map[string]int64
+	// in order of id
+	locationList []profileFrame
+	functionList []profileFunction
+	stringList   []string
+}
+
+type profileSample struct {
+	locations []uint64
+	count     int64
+	nanos     int64
+}
+
+type profileFunction struct {
+	name     string
+	filename string
+	start    int
+}
+
+type profileFrame struct {
+	function profileFunction
+	line     int
+}
+
+// Starts recording a CPU profile of the lua code run by L, the profile is
+// written to w in the pprof format when StopCPUProfile is called and can
+// be analysed with go tool pprof.
+//
+// The lua stack is sampled every ProfileSampleInstructions instructions
+// by a count hook and whenever a go function pushed with PushGoFunction
+// or PushGoClosure is entered or returns, every sample is weighted with
+// the time elapsed since the previous one. Time spent inside go functions
+// is thus charged to them, time spent in C functions is charged to the lua
+// code that called them. The time between the calls from go to lua, with
+// Call or Coroutine.Resume, isn't part of the profile.
+func (L *State) StartCPUProfile(w io.Writer) error {
+	if L.profiler != nil {
+		return errors.New("lua: cpu profiling already in use")
+	}
+	now := time.Now()
+	p := &profiler{
+		L:          L,
+		w:          w,
+		start:      now,
+		last:       now,
+		samples:    make(map[string]*profileSample),
+		locations:  make(map[profileFrame]uint64),
+		functions:  make(map[profileFunction]uint64),
+		strings:    map[string]int64{"": 0},
+		stringList: []string{""},
+	}
+	p.hookID = L.addHook(&hook{mask: LUA_MASKCOUNT, count: ProfileSampleInstructions, countFn: func(L *State) {
+		p.sample(L.stackTrace(false))
+	}})
+	L.profiler = p
+	return nil
+}
+
+// Stops the profile started by StartCPUProfile and writes it
+func (L *State) StopCPUProfile() error {
+	p := L.profiler
+	if p == nil {
+		return nil
+	}
+	L.profiler = nil
+	L.RemoveHook(p.hookID)
+	return p.write(time.Now())
+}
+
+// Samples the lua code that calls a go function, returns the stack trace
+// to be used by leaveGo
+func (p *profiler) enterGo() []LuaStackEntry {
+	st := p.L.stackTrace(false)
+	if len(st) > 0 {
+		p.sample(st[1:])
+	}
+	return st
+}
+
+// Samples the go function that is returning, st comes from enterGo
+func (p *profiler) leaveGo(st []LuaStackEntry) {
+	// the profile may have been stopped by the go function
+	if p.L.profiler == p {
+		p.sample(st)
+	}
+}
+
+// Called when lua code starts running from go, the time spent outside of
+// lua since the previous sample isn't charged to any stack
+func (p *profiler) resume() {
+	p.last = time.Now()
+}
+
+// Charges the time elapsed since the previous sample to the stack st
+func (p *profiler) sample(st []LuaStackEntry) {
+	now := time.Now()
+	elapsed := now.Sub(p.last).Nanoseconds()
+	p.last = now
+	if len(st) == 0 {
+		return
+	}
+
+	locs := make([]uint64, len(st))
+	var key strings.Builder
+	for i, e := range st {
+		locs[i] = p.location(e)
+		fmt.Fprintf(&key, "%d,", locs[i])
+	}
+	s, ok := p.samples[key.String()]
+	if !ok {
+		s = &profileSample{locations: locs}
+		p.samples[key.String()] = s
+	}
+	s.count++
+	s.nanos += elapsed
+}
+
+// Returns the id of the location of the frame e, one per function and line
+func (p *profiler) location(e LuaStackEntry) uint64 {
+	f := profileFunction{name: profileFunctionName(e), filename: e.ShortSource, start: e.LineDefined}
+	if strings.HasPrefix(e.Source, "@") {
+		f.filename = e.Source[1:]
+	}
+	if e.What == "Go" {
+		f.filename, f.start = "", 0
+	}
+	if f.start < 0 {
+		// C functions, pprof uses 0 for unknown lines
+		f.start = 0
+	}
+	fr := profileFrame{function: f, line: e.CurrentLine}
+	if fr.line < 0 {
+		fr.line = 0
+	}
+	if id, ok := p.locations[fr]; ok {
+		return id
+	}
+	if _, ok := p.functions[f]; !ok {
+		p.functionList = append(p.functionList, f)
+		p.functions[f] = uint64(len(p.functionList))
+	}
+	p.locationList = append(p.locationList, fr)
+	id := uint64(len(p.locationList))
+	p.locations[fr] = id
+	return id
+}
+
+func profileFunctionName(e LuaStackEntry) string {
+	switch {
+	case e.What == "Go" && e.GoFunction != "":
+		return e.GoFunction
+	case e.What == "main":
+		return "main chunk"
+	case e.Name != "":
+		return e.Name
+	case e.What == "Lua":
+		return fmt.Sprintf("function <%s:%d>", e.ShortSource, e.LineDefined)
+	}
+	return "?"
+}
+
+func (p *profiler) str(s string) int64 {
+	if i, ok := p.strings[s]; ok {
+		return i
+	}
+	p.stringList = append(p.stringList, s)
+	i := int64(len(p.stringList) - 1)
+	p.strings[s] = i
+	return i
+}
+
+// Writes the profile as a gzipped profile.proto message, see
+// https://github.com/google/pprof/blob/master/proto/profile.proto
+func (p *profiler) write(end time.Time) error {
+	var b protoBuffer
+
+	valueType := func(typ, unit string) []byte {
+		var vt protoBuffer
+		vt.int64(1, p.str(typ))
+		vt.int64(2, p.str(unit))
+		return vt.data
+	}
+	b.bytes(1, valueType("samples", "count"))
+	b.bytes(1, valueType("cpu", "nanoseconds"))
+
+	for _, s := range p.samples {
+		var sb protoBuffer
+		sb.packedUint64(1, s.locations)
+		sb.packedInt64(2, []int64{s.count, s.nanos})
+		b.bytes(2, sb.data)
+	}
+
+	for i, fr := range p.locationList {
+		var line protoBuffer
+		line.uint64(1, p.functions[fr.function])
+		line.int64(2, int64(fr.line))
+		var lb protoBuffer
+		lb.uint64(1, uint64(i+1))
+		lb.bytes(4, line.data)
+		b.bytes(4, lb.data)
+	}
+
+	for i, f := range p.functionList {
+		var fb protoBuffer
+		fb.uint64(1, uint64(i+1))
+		fb.int64(2, p.str(f.name))
+		fb.int64(3, p.str(f.name))
+		fb.int64(4, p.str(f.filename))
+		fb.int64(5, int64(f.start))
+		b.bytes(5, fb.data)
+	}
+
+	b.int64(9, p.start.UnixNano())
+	b.int64(10, end.Sub(p.start).Nanoseconds())
+	b.bytes(11, valueType("instructions", "count"))
+	b.int64(12, ProfileSampleInstructions)
+
+	for _, s := range p.stringList {
+		b.bytes(6, []byte(s))
+	}
+
+	zw := gzip.NewWriter(p.w)
+	if _, err := zw.Write(b.data); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// Minimal protocol buffers encoder for the profile
+type protoBuffer struct {
+	data []byte
+}
+
+func (b *protoBuffer) varint(x uint64) {
+	for x >= 0x80 {
+		b.data = append(b.data, byte(x)|0x80)
+		x >>= 7
+	}
+	b.data = append(b.data, byte(x))
+}
+
+func (b *protoBuffer) uint64(tag int, x uint64) {
+	b.varint(uint64(tag)<<3 | 0)
+	b.varint(x)
+}
+
+func (b *protoBuffer) int64(tag int, x int64) {
+	b.uint64(tag, uint64(x))
+}
+
+func (b *protoBuffer) bytes(tag int, data []byte) {
+	b.varint(uint64(tag)<<3 | 2)
+	b.varint(uint64(len(data)))
+	b.data = append(b.data, data...)
+}
+
+func (b *protoBuffer) packedUint64(tag int, xs []uint64) {
+	var pb protoBuffer
+	for _, x := range xs {
+		pb.varint(x)
+	}
+	b.bytes(tag, pb.data)
+}
+
+func (b *protoBuffer) packedInt64(tag int, xs []int64) {
+	var pb protoBuffer
+	for _, x := range xs {
+		pb.varint(uint64(x))
+	}
+	b.bytes(tag, pb.data)
+}
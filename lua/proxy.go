@@ -0,0 +1,498 @@
+package lua
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// Objects pushed with PushGoStruct are proxies: reading and writing their
+// fields, elements or keys reads and writes the underlying go value.
+//
+// The value stored in the registry is either a pointer to a struct, a
+// map, a slice or an array, or one of those types directly. Composite
+// fields are pushed as new proxies pointing inside the parent object, so
+// that assignments like cfg.Limits.MaxConns = 10 reach the go value.
+
+// Registry entry of proxies whose fields can't be assigned from lua, used
+// for values reached through readonly fields and for copies of values that
+// can't be addressed, like the structs stored in maps
+type readOnlyProxy struct {
+	value  interface{}
+	copied bool
+}
+
+// Returns the value of a registry entry and whether it is read only
+func unwrapProxy(entry interface{}) (interface{}, bool) {
+	if ro, ok := entry.(readOnlyProxy); ok {
+		return ro.value, true
+	}
+	return entry, false
+}
+
+func (L *State) pushGoStructProxy(iface interface{}, readonly bool) {
+	if readonly {
+		L.PushGoStruct(readOnlyProxy{value: iface})
+	} else {
+		L.PushGoStruct(iface)
+	}
+}
+
+// Returns the go value behind the proxy iface, following pointers
+func proxyTarget(iface interface{}) reflect.Value {
+	v := reflect.ValueOf(iface)
+	if v.Kind() == reflect.Ptr && !v.IsNil() {
+		switch v.Elem().Kind() {
+		case reflect.Struct, reflect.Map, reflect.Slice, reflect.Array:
+			return v.Elem()
+		}
+	}
+	return v
+}
+
+// Pushes the value of a field, element or map value. Composite values are
+// pushed as proxies, read only if readonly is set. Structs and arrays that
+// can't be addressed are pushed as read only proxies of a copy, since
+// assignments to their fields would be lost.
+func (L *State) pushProxyValue(v reflect.Value, readonly bool) error {
+	switch v.Kind() {
+	case reflect.Bool:
+		L.PushBoolean(v.Bool())
+		return nil
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		L.PushInteger(v.Int())
+		return nil
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		L.pushUint(v.Uint())
+		return nil
+
+	case reflect.String:
+		L.PushString(v.String())
+		return nil
+
+	case reflect.Float32, reflect.Float64:
+		L.PushNumber(v.Float())
+		return nil
+
+	case reflect.Ptr:
+		if v.IsNil() {
+			L.PushNil()
+			return nil
+		}
+		switch v.Elem().Kind() {
+		case reflect.Struct, reflect.Map, reflect.Slice, reflect.Array:
+			if v.CanInterface() {
+				L.pushGoStructProxy(v.Interface(), readonly)
+				return nil
+			}
+		}
+		return L.pushProxyValue(v.Elem(), readonly)
+
+	case reflect.Interface:
+		if v.IsNil() {
+			L.PushNil()
+			return nil
+		}
+		return L.pushProxyValue(v.Elem(), readonly)
+
+	case reflect.Slice:
+		if v.Type() == typeOfBytes {
+			if v.Len() == 0 {
+				L.PushString("")
+			} else {
+				L.PushBytes(v.Bytes())
+			}
+			return nil
+		}
+		fallthrough
+	case reflect.Struct, reflect.Map, reflect.Array:
+		if !v.CanInterface() {
+			break
+		}
+		if v.CanAddr() {
+			L.pushGoStructProxy(v.Addr().Interface(), readonly)
+			return nil
+		}
+		if v.Kind() == reflect.Map || v.Kind() == reflect.Slice {
+			// a copy still refers to the same elements
+			L.pushGoStructProxy(v.Interface(), readonly)
+			return nil
+		}
+		c := reflect.New(v.Type())
+		c.Elem().Set(v)
+		L.PushGoStruct(readOnlyProxy{value: c.Interface(), copied: true})
+		return nil
+
+	case reflect.Func:
+		if v.IsNil() {
+			L.PushNil()
+			return nil
+		}
+		if v.CanInterface() {
+			L.PushFunc(v.Interface())
+			return nil
+		}
+	}
+
+	return fmt.Errorf("Unsupported type of field: %s", v.Type())
+}
+
+// Assigns the lua value at index to v. Scalars keep the lenient
+// conversions PushGoStruct always had, composite values are decoded with
+// ToValue.
+func (L *State) assignProxyValue(v reflect.Value, index int) error {
+	if !v.CanSet() {
+		return fmt.Errorf("not assignable")
+	}
+
+	if v.Kind() == reflect.Ptr && !v.IsNil() {
+		switch v.Elem().Kind() {
+		case reflect.Struct, reflect.Map, reflect.Slice, reflect.Array, reflect.Ptr, reflect.Interface:
+		default:
+			if !L.IsNil(index) {
+				return L.assignProxyValue(v.Elem(), index)
+			}
+		}
+	}
+
+	luatype := L.Type(index)
+	switch v.Kind() {
+	case reflect.Bool:
+		if luatype == LUA_TBOOLEAN {
+			v.SetBool(L.ToBoolean(index))
+			return nil
+		}
+		return L.conversionError(index, "boolean", "")
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if luatype == LUA_TNUMBER {
+			v.SetInt(int64(L.ToInteger(index)))
+			return nil
+		}
+		return L.conversionError(index, "number", "")
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if luatype == LUA_TNUMBER {
+			v.SetUint(uint64(L.ToInteger(index)))
+			return nil
+		}
+		return L.conversionError(index, "number", "")
+
+	case reflect.String:
+		if luatype == LUA_TSTRING {
+			v.SetString(L.ToString(index))
+			return nil
+		}
+		return L.conversionError(index, "string", "")
+
+	case reflect.Float32, reflect.Float64:
+		if luatype == LUA_TNUMBER {
+			v.SetFloat(L.ToNumber(index))
+			return nil
+		}
+		return L.conversionError(index, "number", "")
+
+	case reflect.Func, reflect.Chan, reflect.UnsafePointer, reflect.Complex64, reflect.Complex128:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+
+	// decode into a fresh value so that assignments replace the old value
+	nv := reflect.New(v.Type()).Elem()
+	if err := L.decodeValue(index, nv, ""); err != nil {
+		return err
+	}
+	v.Set(nv)
+	return nil
+}
+
+// Returns the exported method name of the proxy iface. Read only proxies
+// only have the methods with a value receiver, called on a copy, so that
+// they can't modify the value.
+func proxyMethod(iface interface{}, readonly bool, name string) reflect.Value {
+	recv := reflect.ValueOf(iface)
+	if readonly && recv.Kind() == reflect.Ptr && !recv.IsNil() {
+		recv = reflect.ValueOf(recv.Elem().Interface())
+	}
+	return recv.MethodByName(name)
+}
+
+// Converts the key at index to a 0-based sequence index
+func (L *State) proxySeqIndex(index int) (int, bool) {
+	if L.Type(index) != LUA_TNUMBER {
+		return 0, false
+	}
+	n := L.ToNumber(index)
+	i := int(n)
+	if float64(i) != n {
+		return 0, false
+	}
+	return i - 1, true
+}
+
+// __index for proxies, the key is at stack index 2. The field name is
+// only valid when the key is a string.
+func (L *State) proxyIndex(entry interface{}, name string, hasName bool) int {
+	iface, readonly := unwrapProxy(entry)
+	v := proxyTarget(iface)
+
+	var fval reflect.Value
+	switch v.Kind() {
+	case reflect.Struct:
+		if !hasName {
+			L.PushNil()
+			return 1
+		}
+		f, ok := luaFieldByName(v.Type(), name)
+		if ok {
+			fval, ok = fieldByIndex(v, f.index)
+			if !ok {
+				// behind a nil embedded pointer
+				L.PushNil()
+				return 1
+			}
+			readonly = readonly || f.readonly
+			break
+		}
+		if m := proxyMethod(iface, readonly, name); m.IsValid() {
+			L.pushGoMethod(iface, m)
+			return 1
+		}
+		L.PushString("Unknown field " + name)
+		return -1
+
+	case reflect.Slice, reflect.Array:
+		if hasName {
+			if m := proxyMethod(iface, readonly, name); m.IsValid() {
+				L.pushGoMethod(iface, m)
+				return 1
+			}
+		}
+		i, ok := L.proxySeqIndex(2)
+		if !ok || i < 0 || i >= v.Len() {
+			L.PushNil()
+			return 1
+		}
+		fval = v.Index(i)
+
+	case reflect.Map:
+		k := reflect.New(v.Type().Key()).Elem()
+		if L.decodeValue(2, k, "") != nil {
+			L.PushNil()
+			return 1
+		}
+		fval = v.MapIndex(k)
+		if !fval.IsValid() {
+			L.PushNil()
+			return 1
+		}
+
+	default:
+		L.PushString("Unsupported proxy type " + v.Type().String())
+		return -1
+	}
+
+	if err := L.pushProxyValue(fval, readonly); err != nil {
+		L.PushString(err.Error())
+		return -1
+	}
+	return 1
+}
+
+// __newindex for proxies, the key is at stack index 2 and the value at 3.
+func (L *State) proxyNewIndex(entry interface{}, name string, hasName bool) int {
+	iface, readonly := unwrapProxy(entry)
+	v := proxyTarget(iface)
+
+	if readonly {
+		if ro, _ := entry.(readOnlyProxy); ro.copied {
+			L.PushString("Attempt to modify a copy of a go value, assign the whole value instead")
+		} else {
+			L.PushString("Attempt to modify a read only object")
+		}
+		return -1
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		if !hasName {
+			L.PushString("Invalid field name")
+			return -1
+		}
+		f, ok := luaFieldByName(v.Type(), name)
+		if !ok {
+			L.PushString("Unknown field " + name)
+			return -1
+		}
+		if f.readonly {
+			L.PushString("Attempt to modify read only field " + name)
+			return -1
+		}
+		fval, ok := settableField(v, f.index)
+		if !ok {
+			L.PushString("Unassignable field " + name)
+			return -1
+		}
+		if err := L.assignProxyValue(fval, 3); err != nil {
+			L.PushString("Wrong assignment to field " + name + ": " + err.Error())
+			return -1
+		}
+		return 0
+
+	case reflect.Slice, reflect.Array:
+		i, ok := L.proxySeqIndex(2)
+		if !ok || i < 0 || i > v.Len() || (i == v.Len() && (v.Kind() == reflect.Array || !v.CanSet())) {
+			L.PushString(fmt.Sprintf("Index out of range: %s", L.keyString(2)))
+			return -1
+		}
+		if i == v.Len() {
+			// t[#t+1] = x appends
+			e := reflect.New(v.Type().Elem()).Elem()
+			if err := L.assignProxyValue(e, 3); err != nil {
+				L.PushString(fmt.Sprintf("Wrong assignment to index %d: %v", i+1, err))
+				return -1
+			}
+			v.Set(reflect.Append(v, e))
+			return 0
+		}
+		if err := L.assignProxyValue(v.Index(i), 3); err != nil {
+			L.PushString(fmt.Sprintf("Wrong assignment to index %d: %v", i+1, err))
+			return -1
+		}
+		return 0
+
+	case reflect.Map:
+		k := reflect.New(v.Type().Key()).Elem()
+		if err := L.decodeValue(2, k, ""); err != nil {
+			L.PushString("Invalid key: " + err.Error())
+			return -1
+		}
+		if L.IsNil(3) {
+			if !v.IsNil() {
+				v.SetMapIndex(k, reflect.Value{})
+			}
+			return 0
+		}
+		e := reflect.New(v.Type().Elem()).Elem()
+		if err := L.assignProxyValue(e, 3); err != nil {
+			L.PushString(fmt.Sprintf("Wrong assignment to key %s: %v", L.keyString(2), err))
+			return -1
+		}
+		if v.IsNil() {
+			if !v.CanSet() {
+				L.PushString("Assignment to nil map")
+				return -1
+			}
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+		v.SetMapIndex(k, e)
+		return 0
+	}
+
+	L.PushString("Unsupported proxy type " + v.Type().String())
+	return -1
+}
+
+// __len for proxies
+func (L *State) proxyLen(entry interface{}) int {
+	iface, _ := unwrapProxy(entry)
+	v := proxyTarget(iface)
+	switch v.Kind() {
+	case reflect.Slice, reflect.Array, reflect.Map:
+		L.PushInteger(int64(v.Len()))
+		return 1
+	}
+	L.PushString("attempt to get length of " + v.Type().String())
+	return -1
+}
+
+// __pairs and __ipairs for proxies
+func (L *State) proxyPairs(entry interface{}, ipairs bool) int {
+	iface, readonly := unwrapProxy(entry)
+	v := proxyTarget(iface)
+
+	var next LuaGoFunction
+	switch v.Kind() {
+	case reflect.Slice, reflect.Array:
+		next = func(L *State) int {
+			i := 0
+			if L.Type(2) == LUA_TNUMBER {
+				i = L.ToInteger(2)
+			}
+			v := proxyTarget(iface)
+			if i < 0 || i >= v.Len() {
+				L.PushNil()
+				return 1
+			}
+			L.PushInteger(int64(i + 1))
+			if err := L.pushProxyValue(v.Index(i), readonly); err != nil {
+				L.RaiseError(err.Error())
+			}
+			return 2
+		}
+
+	case reflect.Map:
+		if ipairs {
+			break
+		}
+		keys := v.MapKeys()
+		next = func(L *State) int {
+			v := proxyTarget(iface)
+			for len(keys) > 0 {
+				k := keys[0]
+				keys = keys[1:]
+				e := v.MapIndex(k)
+				if !e.IsValid() {
+					// deleted during the iteration
+					continue
+				}
+				if err := L.PushGoValue(k.Interface()); err != nil {
+					L.RaiseError(err.Error())
+				}
+				if err := L.pushProxyValue(e, readonly); err != nil {
+					L.RaiseError(err.Error())
+				}
+				return 2
+			}
+			L.PushNil()
+			return 1
+		}
+
+	case reflect.Struct:
+		if ipairs {
+			break
+		}
+		fields := luaFieldsOf(v.Type())
+		i := 0
+		next = func(L *State) int {
+			v := proxyTarget(iface)
+			for ; i < len(fields); i++ {
+				f := fields[i]
+				fval, ok := fieldByIndex(v, f.index)
+				if !ok {
+					continue
+				}
+				L.PushString(f.name)
+				if err := L.pushProxyValue(fval, readonly || f.readonly); err != nil {
+					// not representable in lua, skip it
+					L.Pop(1)
+					continue
+				}
+				i++
+				return 2
+			}
+			L.PushNil()
+			return 1
+		}
+	}
+
+	if next == nil {
+		L.PushString("attempt to iterate over " + v.Type().String())
+		return -1
+	}
+
+	L.PushGoClosure(next)
+	L.PushValue(1)
+	L.PushNil()
+	return 3
+}
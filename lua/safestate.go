@@ -0,0 +1,195 @@
+package lua
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// Returned by the methods of a closed SafeState
+var ErrSafeStateClosed = errors.New("lua: SafeState closed")
+
+// A State usable from any goroutine: it is owned by a goroutine locked to
+// its OS thread, which runs the functions given to Do one at a time.
+type SafeState struct {
+	requests chan safeRequest
+	quit     chan struct{}
+	done     chan struct{}
+	once     sync.Once
+}
+
+type safeRequest struct {
+	ctx    context.Context
+	f      func(*State) error
+	result chan error
+}
+
+// Creates a SafeState, the State is created on its goroutine by newState,
+// or by NewState followed by OpenLibs when newState is nil. At most
+// queueSize calls of Do wait for their turn, the following ones block
+// until there is room in the queue.
+func NewSafeState(queueSize int, newState func() *State) (*SafeState, error) {
+	if newState == nil {
+		newState = func() *State {
+			L := NewState()
+			if L != nil {
+				L.OpenLibs()
+			}
+			return L
+		}
+	}
+	s := &SafeState{
+		requests: make(chan safeRequest, queueSize),
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	started := make(chan bool)
+	go func() {
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+		defer close(s.done)
+		L := newState()
+		started <- L != nil
+		if L != nil {
+			s.loop(L)
+		}
+	}()
+	if !<-started {
+		return nil, errors.New("lua: could not create the State of a SafeState")
+	}
+	return s, nil
+}
+
+func (s *SafeState) loop(L *State) {
+	defer L.Close()
+	for {
+		select {
+		case req := <-s.requests:
+			req.result <- s.run(L, req)
+		case <-s.quit:
+			for {
+				select {
+				case req := <-s.requests:
+					req.result <- ErrSafeStateClosed
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// Runs a request, a panic of its function is returned as an error and the
+// stack is emptied for the next one
+func (s *SafeState) run(L *State, req safeRequest) (err error) {
+	if err := req.ctx.Err(); err != nil {
+		return err
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			if e, ok := p.(error); ok {
+				err = e
+			} else {
+				err = fmt.Errorf("lua: panic in SafeState.Do: %v", p)
+			}
+		}
+		L.SetTop(0)
+	}()
+	return req.f(L)
+}
+
+// Runs f with the State and returns its error, see DoContext
+func (s *SafeState) Do(f func(*State) error) error {
+	return s.DoContext(context.Background(), f)
+}
+
+// Runs f with the State once the requests queued before it are done and
+// returns its error. Gives up with ctx.Err() if ctx is done before f
+// starts, f is expected to pass ctx to CallContext and such to stop
+// early. f must not call the methods of s, and must not keep the State.
+func (s *SafeState) DoContext(ctx context.Context, f func(*State) error) error {
+	req := safeRequest{ctx: ctx, f: f, result: make(chan error, 1)}
+	select {
+	case s.requests <- req:
+	case <-s.quit:
+		return ErrSafeStateClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-req.result:
+		return err
+	case <-s.done:
+		select {
+		case err := <-req.result:
+			return err
+		default:
+			return ErrSafeStateClosed
+		}
+	}
+}
+
+// Runs the lua code in str and returns its results converted to go
+// values as in Coroutine.Resume. The execution is aborted when ctx is done.
+func (s *SafeState) Eval(ctx context.Context, str string) (results []interface{}, err error) {
+	err = s.DoContext(ctx, func(L *State) error {
+		if r := L.LoadString(str); r != 0 {
+			return L.LoadError(r)
+		}
+		if err := L.CallContext(ctx, 0, LUA_MULTRET); err != nil {
+			return err
+		}
+		results, err = L.decodeResults(1)
+		return err
+	})
+	return results, err
+}
+
+// Calls the function stored in the global variable name, which can be a
+// path such as "pkg.fn", with args converted by PushGoValue. The results
+// are converted as in Coroutine.Resume. The execution is aborted when ctx
+// is done.
+func (s *SafeState) Call(ctx context.Context, name string, args ...interface{}) (results []interface{}, err error) {
+	err = s.DoContext(ctx, func(L *State) error {
+		path := strings.Split(name, ".")
+		L.GetGlobal(path[0])
+		for _, field := range path[1:] {
+			if !L.IsTable(-1) {
+				L.Pop(1)
+				L.PushNil()
+				break
+			}
+			L.GetField(-1, field)
+			L.Remove(-2)
+		}
+		if !L.IsFunction(-1) {
+			return fmt.Errorf("lua: %s is not a function", name)
+		}
+		if !L.CheckStack(len(args)) {
+			return errors.New("lua: too many arguments")
+		}
+		for _, arg := range args {
+			if err := L.PushGoValue(arg); err != nil {
+				return err
+			}
+		}
+		if err := L.CallContext(ctx, len(args), LUA_MULTRET); err != nil {
+			return err
+		}
+		results, err = L.decodeResults(1)
+		return err
+	})
+	return results, err
+}
+
+// Closes the State once the running request is done, the queued ones fail
+// with ErrSafeStateClosed
+func (s *SafeState) Close() {
+	s.once.Do(func() {
+		close(s.quit)
+	})
+	<-s.done
+}
@@ -0,0 +1,189 @@
+package lua
+
+import (
+	"strings"
+)
+
+// Configuration of NewSandboxState
+type SandboxOptions struct {
+	// Global variables and library functions reachable by the scripts, as
+	// "name", "library.name" or "library.*" for a whole library. Names that
+	// don't exist in the lua version in use are ignored. Nil means
+	// DefaultSandboxAllowlist.
+	//
+	// "load" and "loadstring" are replaced by versions that only compile
+	// source code. dofile, loadfile, require, package, io and debug give
+	// access to the host and must not be allowed for untrusted code.
+	Allow []string
+
+	// Maximum memory in bytes, 0 for no limit, see NewStateWithMemoryLimit
+	MemoryLimit uint
+
+	// Maximum number of instructions, 0 for no limit, see SetExecutionLimit
+	InstructionLimit int
+}
+
+// Functions available to sandboxed scripts unless SandboxOptions.Allow says
+// otherwise: the pure functions of the standard library, without anything
+// that can load code, reach the file system, the process or the registry,
+// or escape the sandbox through metatables of strings.
+var DefaultSandboxAllowlist = []string{
+	"_G", "_VERSION",
+	"assert", "error", "ipairs", "next", "pairs", "select", "tonumber",
+	"tostring", "type", "unpack", "rawequal", "rawget", "rawlen", "rawset",
+	"getmetatable", "setmetatable", "pcall", "xpcall",
+	"coroutine.*",
+	"math.*",
+	"os.clock", "os.date", "os.difftime", "os.time",
+	"string.byte", "string.char", "string.find", "string.format",
+	"string.gmatch", "string.gsub", "string.len", "string.lower",
+	"string.match", "string.rep", "string.reverse", "string.sub",
+	"string.upper",
+	"table.*",
+	"utf8.*",
+}
+
+// Creates a lua state for untrusted scripts: only the functions allowed by
+// opts are reachable, precompiled chunks can't be loaded and the string
+// metatable is protected. The memory and instruction limits of opts are
+// applied once the sandbox is set up. Returns nil if the state can't be
+// created or if the memory limit is too low for the setup.
+func NewSandboxState(opts SandboxOptions) *State {
+	var L *State
+	if opts.MemoryLimit > 0 {
+		// the setup isn't protected, the limit is set at the end
+		L = NewStateWithMemoryLimit(0)
+	} else {
+		L = NewState()
+	}
+	if L == nil {
+		return nil
+	}
+	L.OpenLibs()
+
+	allow := opts.Allow
+	if allow == nil {
+		allow = DefaultSandboxAllowlist
+	}
+	globals := make(map[string]bool)
+	fields := make(map[string]map[string]bool)
+	for _, name := range allow {
+		i := strings.Index(name, ".")
+		if i < 0 {
+			globals[name] = true
+			continue
+		}
+		lib, field := name[:i], name[i+1:]
+		if fields[lib] == nil {
+			fields[lib] = make(map[string]bool)
+		}
+		fields[lib][field] = true
+	}
+
+	// the string methods are reachable without the string global
+	L.PushString("")
+	if L.GetMetaTable(-1) {
+		L.GetField(-1, "__index")
+		if L.IsTable(-1) {
+			L.filterTable(-1, fields["string"])
+		}
+		L.Pop(1)
+		L.PushBoolean(false)
+		L.SetField(-2, "__metatable")
+		L.Pop(1)
+	}
+	L.Pop(1)
+
+	L.pushGlobalTable()
+	for _, name := range L.stringKeys(-1) {
+		if globals[name] {
+			if name == "load" || name == "loadstring" {
+				L.PushGoClosure(sandboxLoad)
+				L.SetField(-2, name)
+			}
+			continue
+		}
+		L.GetField(-1, name)
+		isTable := L.IsTable(-1)
+		if isTable && fields[name] != nil {
+			L.filterTable(-1, fields[name])
+		}
+		L.Pop(1)
+		if !isTable || fields[name] == nil {
+			L.PushNil()
+			L.SetField(-2, name)
+		}
+	}
+	L.Pop(1)
+
+	if opts.MemoryLimit > 0 {
+		if L.MemoryUsage() > opts.MemoryLimit {
+			L.Close()
+			return nil
+		}
+		L.SetMemoryLimit(opts.MemoryLimit)
+	}
+	if opts.InstructionLimit > 0 {
+		L.SetExecutionLimit(opts.InstructionLimit)
+	}
+	return L
+}
+
+// Returns the string keys of the table at index
+func (L *State) stringKeys(index int) []string {
+	index = L.absIndex(index)
+	var keys []string
+	L.PushNil()
+	for L.Next(index) != 0 {
+		if L.Type(-2) == LUA_TSTRING {
+			keys = append(keys, L.ToString(-2))
+		}
+		L.Pop(1)
+	}
+	return keys
+}
+
+// Removes the fields of the table at index that aren't in allowed, a "*"
+// entry allows every field
+func (L *State) filterTable(index int, allowed map[string]bool) {
+	if allowed["*"] {
+		return
+	}
+	index = L.absIndex(index)
+	for _, name := range L.stringKeys(index) {
+		if !allowed[name] {
+			L.PushNil()
+			L.SetField(index, name)
+		}
+	}
+}
+
+// load(chunk [, chunkname [, mode [, env]]]) of sandboxed states, chunk must
+// be lua source code in a string
+func sandboxLoad(L *State) int {
+	if L.Type(1) != LUA_TSTRING {
+		L.PushNil()
+		L.PushString("only strings can be loaded")
+		return 2
+	}
+	chunk := L.ToString(1)
+	if strings.HasPrefix(chunk, "\x1b") {
+		L.PushNil()
+		L.PushString("attempt to load a binary chunk")
+		return 2
+	}
+	name := chunk
+	if L.Type(2) == LUA_TSTRING {
+		name = L.ToString(2)
+	}
+	if L.Load([]byte(chunk), name) != 0 {
+		L.PushNil()
+		L.Insert(-2)
+		return 2
+	}
+	if L.Type(4) == LUA_TTABLE {
+		L.PushValue(4)
+		L.setFunctionEnv(-2)
+	}
+	return 1
+}
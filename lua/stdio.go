@@ -0,0 +1,565 @@
+package lua
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// Registry keys of the standard streams set by SetStdout, SetStderr and
+// SetStdin, and of the functions of the io library they replace
+const (
+	stdoutKey = "golua_stdout"
+	stderrKey = "golua_stderr"
+	stdinKey  = "golua_stdin"
+
+	// whether io.write and io.read use the redirected streams, io.output
+	// and io.input with a file make them use the original functions
+	stdoutDefaultKey = "golua_stdout_default"
+	stdinDefaultKey  = "golua_stdin_default"
+
+	ioOriginalPrefix = "golua_io_"
+
+	// the print of the base library and the one set by SetStdout, only
+	// they are replaced by SetStdout
+	basePrintKey   = "golua_base_print"
+	stdoutPrintKey = "golua_stdout_print"
+)
+
+// Makes print, io.write and io.stdout write to w instead of the C stdout
+// of the process, for this State and its threads only. print is only
+// replaced while it is the function of the base library, or the one set by
+// a previous call. io.output() returns the new io.stdout until io.output
+// is given another file. The redirected
+// streams are tables rather than userdata: io.type reports them as files
+// but their seek method always fails.
+func (L *State) SetStdout(w io.Writer) {
+	L.pushStreamFile("stdout", w, nil)
+	L.SetField(LUA_REGISTRYINDEX, stdoutKey)
+	L.PushBoolean(true)
+	L.SetField(LUA_REGISTRYINDEX, stdoutDefaultKey)
+
+	if L.isStockPrint() {
+		L.PushGoClosure(func(L *State) int {
+			L.printTo(w)
+			return 0
+		})
+		L.PushValue(-1)
+		L.SetField(LUA_REGISTRYINDEX, stdoutPrintKey)
+		L.SetGlobal("print")
+	}
+
+	if !L.getIOLibrary() {
+		return
+	}
+	L.GetField(LUA_REGISTRYINDEX, stdoutKey)
+	L.SetField(-2, "stdout")
+	L.replaceIOType()
+	L.replaceIOFunction("write", func(L *State) int {
+		if !L.streamIsDefault(stdoutDefaultKey) {
+			return L.callIOOriginal("write")
+		}
+		L.GetField(LUA_REGISTRYINDEX, stdoutKey)
+		L.Insert(1)
+		return L.writeStream(w, 2)
+	})
+	L.replaceIOFunction("output", func(L *State) int {
+		return L.selectStream(stdoutKey, stdoutDefaultKey, "output")
+	})
+	L.Pop(1)
+}
+
+// Makes io.stderr write to w instead of the C stderr of the process, for
+// this State and its threads only
+func (L *State) SetStderr(w io.Writer) {
+	L.pushStreamFile("stderr", w, nil)
+	L.SetField(LUA_REGISTRYINDEX, stderrKey)
+	if !L.getIOLibrary() {
+		return
+	}
+	L.GetField(LUA_REGISTRYINDEX, stderrKey)
+	L.SetField(-2, "stderr")
+	L.replaceIOType()
+	L.Pop(1)
+}
+
+// Makes io.read, io.lines without a file name and io.stdin read from r
+// instead of the C stdin of the process, for this State and its threads
+// only. io.input() returns the new io.stdin until io.input is given
+// another file.
+func (L *State) SetStdin(r io.Reader) {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	L.pushStreamFile("stdin", nil, br)
+	L.SetField(LUA_REGISTRYINDEX, stdinKey)
+	L.PushBoolean(true)
+	L.SetField(LUA_REGISTRYINDEX, stdinDefaultKey)
+
+	if !L.getIOLibrary() {
+		return
+	}
+	L.GetField(LUA_REGISTRYINDEX, stdinKey)
+	L.SetField(-2, "stdin")
+	L.replaceIOType()
+	L.replaceIOFunction("read", func(L *State) int {
+		if !L.streamIsDefault(stdinDefaultKey) {
+			return L.callIOOriginal("read")
+		}
+		return L.readStream(br, 1)
+	})
+	L.replaceIOFunction("lines", func(L *State) int {
+		if L.GetTop() > 0 && !L.IsNil(1) || !L.streamIsDefault(stdinDefaultKey) {
+			return L.callIOOriginal("lines")
+		}
+		L.pushLinesIterator(br, 2)
+		return 1
+	})
+	L.replaceIOFunction("input", func(L *State) int {
+		return L.selectStream(stdinKey, stdinDefaultKey, "input")
+	})
+	L.Pop(1)
+}
+
+// Records the print function of the base library, see isStockPrint
+func (L *State) saveBasePrint() {
+	L.GetGlobal("print")
+	L.SetField(LUA_REGISTRYINDEX, basePrintKey)
+}
+
+// Reports whether the global print is the one of the base library or the
+// one set by SetStdout, rather than a function of the program or nothing
+func (L *State) isStockPrint() bool {
+	L.GetGlobal("print")
+	defer L.Pop(1)
+	if L.IsNil(-1) {
+		return false
+	}
+	for _, key := range []string{basePrintKey, stdoutPrintKey} {
+		L.GetField(LUA_REGISTRYINDEX, key)
+		stock := L.RawEqual(-1, -2)
+		L.Pop(1)
+		if stock {
+			return true
+		}
+	}
+	return false
+}
+
+// Pushes the io table and returns true, or returns false if the io
+// library isn't open
+func (L *State) getIOLibrary() bool {
+	L.GetGlobal("io")
+	if !L.IsTable(-1) {
+		L.Pop(1)
+		return false
+	}
+	return true
+}
+
+// Sets the field name of the io table on top of the stack to f, the
+// function it replaces is kept for callIOOriginal
+func (L *State) replaceIOFunction(name string, f LuaGoFunction) {
+	L.GetField(LUA_REGISTRYINDEX, ioOriginalPrefix+name)
+	saved := !L.IsNil(-1)
+	L.Pop(1)
+	if !saved {
+		L.GetField(-1, name)
+		L.SetField(LUA_REGISTRYINDEX, ioOriginalPrefix+name)
+	}
+	L.PushGoClosure(f)
+	L.SetField(-2, name)
+}
+
+// Replaces io.type, in the io table on top of the stack, with a function
+// that reports the redirected streams as open files
+func (L *State) replaceIOType() {
+	L.replaceIOFunction("type", func(L *State) int {
+		for _, key := range []string{stdoutKey, stderrKey, stdinKey} {
+			L.GetField(LUA_REGISTRYINDEX, key)
+			stream := L.RawEqual(1, -1)
+			L.Pop(1)
+			if stream {
+				L.PushString("file")
+				return 1
+			}
+		}
+		return L.callIOOriginal("type")
+	})
+}
+
+// Calls the original io function name with the arguments of the running
+// go function and returns its results
+func (L *State) callIOOriginal(name string) int {
+	L.GetField(LUA_REGISTRYINDEX, ioOriginalPrefix+name)
+	L.Insert(1)
+	if err := L.Call(L.GetTop()-1, LUA_MULTRET); err != nil {
+		panic(err)
+	}
+	return L.GetTop()
+}
+
+func (L *State) streamIsDefault(key string) bool {
+	L.GetField(LUA_REGISTRYINDEX, key)
+	defer L.Pop(1)
+	return L.ToBoolean(-1)
+}
+
+// io.output and io.input: without arguments returns the redirected stream
+// while it is the default, the stream itself makes it the default again
+// and anything else is handled by the original function
+func (L *State) selectStream(key, defaultKey, name string) int {
+	L.GetField(LUA_REGISTRYINDEX, key)
+	stream := L.GetTop()
+	switch {
+	case L.GetTop() == 1 || L.IsNil(1):
+		if L.streamIsDefault(defaultKey) {
+			return 1
+		}
+		L.SetTop(0)
+		return L.callIOOriginal(name)
+	case L.RawEqual(1, stream):
+		L.PushBoolean(true)
+		L.SetField(LUA_REGISTRYINDEX, defaultKey)
+		return 1
+	}
+	L.Pop(1)
+	L.PushBoolean(false)
+	L.SetField(LUA_REGISTRYINDEX, defaultKey)
+	return L.callIOOriginal(name)
+}
+
+// Pushes a table behaving like the file objects of the io library,
+// writing to w or reading from r. It can't seek and it is not a userdata,
+// only the io.type installed by replaceIOType knows it is a file.
+func (L *State) pushStreamFile(name string, w io.Writer, r *bufio.Reader) {
+	L.NewTable()
+	L.NewTable()
+	L.NewTable()
+	methods := map[string]LuaGoFunction{
+		"close": func(L *State) int {
+			L.PushNil()
+			L.PushString("cannot close standard file")
+			return 2
+		},
+		"flush": func(L *State) int {
+			if f, ok := w.(interface{ Flush() error }); ok {
+				if err := f.Flush(); err != nil {
+					L.PushNil()
+					L.PushString(err.Error())
+					return 2
+				}
+			}
+			L.PushValue(1)
+			return 1
+		},
+		"seek": func(L *State) int {
+			L.PushNil()
+			L.PushString("cannot seek on a redirected standard file")
+			return 2
+		},
+		"setvbuf": func(L *State) int {
+			L.PushBoolean(true)
+			return 1
+		},
+		"write": func(L *State) int {
+			if w == nil {
+				L.PushNil()
+				L.PushString("file not open for writing")
+				return 2
+			}
+			return L.writeStream(w, 2)
+		},
+		"read": func(L *State) int {
+			if r == nil {
+				L.PushNil()
+				L.PushString("file not open for reading")
+				return 2
+			}
+			return L.readStream(r, 2)
+		},
+		"lines": func(L *State) int {
+			if r == nil {
+				L.RaiseError("file not open for reading")
+			}
+			L.pushLinesIterator(r, 2)
+			return 1
+		},
+	}
+	for k, f := range methods {
+		L.PushGoClosure(f)
+		L.SetField(-2, k)
+	}
+	L.SetField(-2, "__index")
+	L.PushGoClosure(func(L *State) int {
+		L.PushString("file (" + name + ")")
+		return 1
+	})
+	L.SetField(-2, "__tostring")
+	L.SetMetaTable(-2)
+}
+
+// print: writes its arguments converted by tostring, separated by tabs
+func (L *State) printTo(w io.Writer) {
+	var b bytes.Buffer
+	n := L.GetTop()
+	for i := 1; i <= n; i++ {
+		if i > 1 {
+			b.WriteByte('\t')
+		}
+		L.GetGlobal("tostring")
+		if !L.IsFunction(-1) {
+			// tostring was removed, by a sandbox for instance
+			L.Pop(1)
+			if t := L.Type(i); t == LUA_TSTRING || t == LUA_TNUMBER {
+				L.PushValue(i)
+				b.Write(L.ToBytes(-1))
+				L.Pop(1)
+			} else {
+				b.WriteString(L.describeValue(i))
+			}
+			continue
+		}
+		L.PushValue(i)
+		if err := L.Call(1, 1); err != nil {
+			panic(err)
+		}
+		if L.Type(-1) != LUA_TSTRING {
+			L.RaiseError("'tostring' must return a string to 'print'")
+		}
+		b.WriteString(L.ToString(-1))
+		L.Pop(1)
+	}
+	b.WriteByte('\n')
+	w.Write(b.Bytes())
+}
+
+// file:write, writes the strings and numbers from index first and returns
+// the file at index 1
+func (L *State) writeStream(w io.Writer, first int) int {
+	var b bytes.Buffer
+	for i := first; i <= L.GetTop(); i++ {
+		switch L.Type(i) {
+		case LUA_TSTRING, LUA_TNUMBER:
+			b.Write(L.ToBytes(i))
+		default:
+			L.RaiseError(fmt.Sprintf("bad argument #%d to 'write' (string expected, got %s)", i-first+1, L.LTypename(i)))
+		}
+	}
+	if _, err := w.Write(b.Bytes()); err != nil {
+		L.PushNil()
+		L.PushString(err.Error())
+		return 2
+	}
+	L.PushValue(1)
+	return 1
+}
+
+// file:read, reads a value for each format from index first, "l" when
+// there is none. Stops with nil at the first format that fails.
+func (L *State) readStream(r *bufio.Reader, first int) int {
+	n := L.GetTop()
+	if n < first {
+		L.readFormat(r, "l")
+		return 1
+	}
+	for i := first; i <= n; i++ {
+		if !L.readFormat(r, L.ToString(i)) {
+			return i - first + 1
+		}
+	}
+	return n - first + 1
+}
+
+// Reads count bytes, pushes nil at the end of the input
+func (L *State) readCount(r *bufio.Reader, count int) bool {
+	if count == 0 {
+		if _, err := r.Peek(1); err != nil {
+			L.PushNil()
+			return false
+		}
+		L.PushString("")
+		return true
+	}
+	buf := make([]byte, count)
+	n, _ := io.ReadFull(r, buf)
+	if n == 0 {
+		L.PushNil()
+		return false
+	}
+	L.PushBytes(buf[:n])
+	return true
+}
+
+// Reads a value in the format of file:read, with or without the * of lua
+// 5.1 and 5.2, or a number of bytes. Pushes nil if it can't be read.
+func (L *State) readFormat(r *bufio.Reader, format string) bool {
+	if count, err := strconv.Atoi(format); err == nil && count >= 0 {
+		return L.readCount(r, count)
+	}
+	format = strings.TrimPrefix(format, "*")
+	if format == "" {
+		L.RaiseError("bad argument to 'read' (invalid format)")
+	}
+	switch format[0] {
+	case 'l', 'L':
+		line, err := r.ReadString('\n')
+		if err != nil && line == "" {
+			L.PushNil()
+			return false
+		}
+		if format[0] == 'l' {
+			line = strings.TrimSuffix(line, "\n")
+		}
+		L.PushString(line)
+		return true
+	case 'a':
+		all, _ := ioutil.ReadAll(r)
+		L.PushBytes(all)
+		return true
+	case 'n':
+		return L.readNumber(r)
+	}
+	L.RaiseError("bad argument to 'read' (invalid format)")
+	return false
+}
+
+// Reads a number after optional spaces, pushes nil if there is none. Like
+// the io library it consumes the longest prefix that can start a numeral:
+// a sign, a 0x prefix, digits, a point and an exponent, in this order.
+func (L *State) readNumber(r *bufio.Reader) bool {
+	var b strings.Builder
+	// consumes the next byte if it is one of chars
+	accept := func(chars string) bool {
+		c, err := r.ReadByte()
+		if err != nil {
+			return false
+		}
+		if strings.IndexByte(chars, c) < 0 {
+			r.UnreadByte()
+			return false
+		}
+		b.WriteByte(c)
+		return true
+	}
+	digits := func(hex bool) int {
+		chars := "0123456789"
+		if hex {
+			chars = "0123456789abcdefABCDEF"
+		}
+		n := 0
+		for accept(chars) {
+			n++
+		}
+		return n
+	}
+
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			break
+		}
+		if strings.IndexByte(" \t\n\r\f\v", c) < 0 {
+			r.UnreadByte()
+			break
+		}
+	}
+	accept("+-")
+	hex, count := false, 0
+	if accept("0") {
+		if accept("xX") {
+			hex = true
+		} else {
+			count = 1
+		}
+	}
+	count += digits(hex)
+	if accept(".") {
+		count += digits(hex)
+	}
+	exponent := "eE"
+	if hex {
+		exponent = "pP"
+	}
+	exp := count > 0 && accept(exponent)
+	if exp {
+		accept("+-")
+		digits(false)
+	}
+
+	s := b.String()
+	if !exp && !strings.Contains(s, ".") {
+		if i, ok := parseIntegerNumeral(s, hex); ok {
+			L.PushInteger(i)
+			return true
+		}
+	}
+	if f, ok := parseFloatNumeral(s, hex, exp); ok {
+		L.PushNumber(f)
+		return true
+	}
+	L.PushNil()
+	return false
+}
+
+// Converts an integer numeral read by readNumber. Decimal integers that
+// don't fit in 64 bits are not converted, hexadecimal ones wrap around as
+// in lua.
+func parseIntegerNumeral(s string, hex bool) (int64, bool) {
+	if !hex {
+		i, err := strconv.ParseInt(s, 10, 64)
+		return i, err == nil
+	}
+	neg := strings.HasPrefix(s, "-")
+	s = strings.TrimLeft(s, "+-")[2:]
+	if s == "" {
+		return 0, false
+	}
+	var u uint64
+	for i := 0; i < len(s); i++ {
+		u = u<<4 | uint64(strings.IndexByte("0123456789abcdef", s[i]|0x20))
+	}
+	if neg {
+		u = -u
+	}
+	return int64(u), true
+}
+
+// Converts a numeral read by readNumber to a float
+func parseFloatNumeral(s string, hex, exp bool) (float64, bool) {
+	if hex && !exp {
+		// go requires an exponent in hexadecimal floats
+		s += "p0"
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil && !errors.Is(err, strconv.ErrRange) {
+		return 0, false
+	}
+	return f, true
+}
+
+// Pushes an iterator returning what file:read returns with the formats
+// from index first, io.lines and file:lines
+func (L *State) pushLinesIterator(r *bufio.Reader, first int) {
+	var formats []string
+	for i := first; i <= L.GetTop(); i++ {
+		formats = append(formats, L.ToString(i))
+	}
+	if len(formats) == 0 {
+		formats = []string{"l"}
+	}
+	L.PushGoClosure(func(L *State) int {
+		for i, format := range formats {
+			if !L.readFormat(r, format) {
+				return i + 1
+			}
+		}
+		return len(formats)
+	})
+}
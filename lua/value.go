@@ -0,0 +1,816 @@
+package lua
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Default nesting limit used by PushGoValue
+const DefaultMaxPushDepth = 64
+
+// Describes a struct field as seen from lua, see luaFieldsOf
+type luaField struct {
+	name       string
+	index      []int
+	def        string
+	hasDefault bool
+	readonly   bool
+}
+
+var luaFieldsCache sync.Map       // reflect.Type -> []luaField
+var luaFieldsByNameCache sync.Map // reflect.Type -> map[string]int
+
+// Returns the fields of struct type t visible from lua.
+//
+// Field names are taken from the `lua:"name,default"` tag when present and
+// from the go field name otherwise, fields tagged with "-" and unexported
+// fields are skipped, embedded structs are flattened. The option
+// "readonly" (`lua:"name,readonly"` or `lua:"name,default,readonly"`)
+// marks fields that lua code can't assign through PushGoStruct. As with
+// the tags read by Table, a tag with options and no name, such as
+// `lua:",readonly"`, names the field after the lower case go field name.
+func luaFieldsOf(t reflect.Type) []luaField {
+	if fs, ok := luaFieldsCache.Load(t); ok {
+		return fs.([]luaField)
+	}
+	fs := appendLuaFields(nil, t, nil)
+	luaFieldsCache.Store(t, fs)
+	return fs
+}
+
+// Looks up a field of struct type t by its lua name
+func luaFieldByName(t reflect.Type, name string) (luaField, bool) {
+	fs := luaFieldsOf(t)
+	m, ok := luaFieldsByNameCache.Load(t)
+	if !ok {
+		byName := make(map[string]int, len(fs))
+		for i := len(fs) - 1; i >= 0; i-- {
+			// the shallowest field wins, like go field promotion
+			if j, dup := byName[fs[i].name]; !dup || len(fs[i].index) <= len(fs[j].index) {
+				byName[fs[i].name] = i
+			}
+		}
+		luaFieldsByNameCache.Store(t, byName)
+		m = byName
+	}
+	i, ok := m.(map[string]int)[name]
+	if !ok {
+		return luaField{}, false
+	}
+	return fs[i], true
+}
+
+func appendLuaFields(fs []luaField, t reflect.Type, index []int) []luaField {
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		idx := make([]int, len(index)+1)
+		copy(idx, index)
+		idx[len(index)] = i
+
+		tag, tagged := sf.Tag.Lookup("lua")
+		if tag == "-" {
+			continue
+		}
+
+		if sf.Anonymous && !tagged {
+			ft := sf.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				fs = appendLuaFields(fs, ft, idx)
+				continue
+			}
+		}
+
+		if sf.PkgPath != "" {
+			// unexported
+			continue
+		}
+
+		f := luaField{name: sf.Name, index: idx}
+		if tagged {
+			parts := strings.Split(tag, ",")
+			if parts[0] != "" {
+				f.name = parts[0]
+			} else if len(parts) > 1 {
+				// same convention as getFields
+				f.name = strings.ToLower(sf.Name)
+			}
+			for _, opt := range parts[1:] {
+				if opt == "readonly" {
+					f.readonly = true
+				} else if !f.hasDefault {
+					f.def = opt
+					f.hasDefault = true
+				}
+			}
+		}
+		fs = append(fs, f)
+	}
+	return fs
+}
+
+// Returns the field of v described by index, ok is false if an embedded
+// pointer along the way is nil
+func fieldByIndex(v reflect.Value, index []int) (f reflect.Value, ok bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return reflect.Value{}, false
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
+
+// Pushes an arbitrary go value onto the stack converting it to the
+// equivalent lua value:
+//
+//   - nil, nil pointers, maps and slices become nil
+//   - booleans, numbers and strings become the corresponding lua type
+//   - byte slices become strings
+//   - slices and arrays become sequences
+//   - maps become tables with converted keys
+//   - structs become tables keyed by the name in the `lua:"name,default"`
+//     tag or by the go field name
+//   - pointers and interfaces are followed
+//
+// Cyclic values and values nested deeper than DefaultMaxPushDepth are
+// refused. On error nothing is pushed onto the stack.
+func (L *State) PushGoValue(v interface{}) error {
+	return L.PushGoValueDepth(v, DefaultMaxPushDepth)
+}
+
+// Like PushGoValue but with a custom nesting limit
+func (L *State) PushGoValueDepth(v interface{}, maxDepth int) error {
+	top := L.GetTop()
+	e := &valueEncoder{L, maxDepth, map[visitKey]bool{}}
+	if err := e.push(reflect.ValueOf(v), 0, ""); err != nil {
+		L.SetTop(top)
+		return err
+	}
+	return nil
+}
+
+type visitKey struct {
+	ptr uintptr
+	typ reflect.Type
+}
+
+type valueEncoder struct {
+	L        *State
+	maxDepth int
+	visiting map[visitKey]bool
+}
+
+func (e *valueEncoder) errorf(path string, format string, args ...interface{}) error {
+	if path == "" {
+		path = "value"
+	}
+	return fmt.Errorf("lua: cannot push %s: %s", path, fmt.Sprintf(format, args...))
+}
+
+// Records v as being on the current path, returns false if it already is
+func (e *valueEncoder) enter(v reflect.Value) (visitKey, bool) {
+	k := visitKey{v.Pointer(), v.Type()}
+	if e.visiting[k] {
+		return k, false
+	}
+	e.visiting[k] = true
+	return k, true
+}
+
+func (e *valueEncoder) push(v reflect.Value, depth int, path string) error {
+	L := e.L
+
+	if !v.IsValid() {
+		L.PushNil()
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		L.PushBoolean(v.Bool())
+		return nil
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		L.PushInteger(v.Int())
+		return nil
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		L.pushUint(v.Uint())
+		return nil
+
+	case reflect.Float32, reflect.Float64:
+		L.PushNumber(v.Float())
+		return nil
+
+	case reflect.String:
+		L.PushString(v.String())
+		return nil
+
+	case reflect.Interface:
+		if v.IsNil() {
+			L.PushNil()
+			return nil
+		}
+		return e.push(v.Elem(), depth, path)
+
+	case reflect.Ptr:
+		if v.IsNil() {
+			L.PushNil()
+			return nil
+		}
+		k, ok := e.enter(v)
+		if !ok {
+			return e.errorf(path, "cycle detected through %s", v.Type())
+		}
+		defer delete(e.visiting, k)
+		return e.push(v.Elem(), depth, path)
+	}
+
+	if v.Kind() == reflect.Slice {
+		if v.IsNil() {
+			L.PushNil()
+			return nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			if v.Len() == 0 {
+				L.PushString("")
+			} else {
+				L.PushBytes(v.Bytes())
+			}
+			return nil
+		}
+	}
+
+	// everything below creates a table
+	if depth >= e.maxDepth {
+		return e.errorf(path, "exceeds maximum depth %d", e.maxDepth)
+	}
+	if !L.CheckStack(3) {
+		return e.errorf(path, "lua stack overflow")
+	}
+
+	switch v.Kind() {
+	case reflect.Slice:
+		if v.Len() > 0 {
+			k, ok := e.enter(v)
+			if !ok {
+				return e.errorf(path, "cycle detected through %s", v.Type())
+			}
+			defer delete(e.visiting, k)
+		}
+		return e.pushSequence(v, depth, path)
+
+	case reflect.Array:
+		return e.pushSequence(v, depth, path)
+
+	case reflect.Map:
+		if v.IsNil() {
+			L.PushNil()
+			return nil
+		}
+		k, ok := e.enter(v)
+		if !ok {
+			return e.errorf(path, "cycle detected through %s", v.Type())
+		}
+		defer delete(e.visiting, k)
+
+		L.CreateTable(0, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			key := iter.Key()
+			kpath := fmt.Sprintf("%s[%v]", path, key)
+			if err := e.pushKey(key, kpath); err != nil {
+				return err
+			}
+			if err := e.push(iter.Value(), depth+1, kpath); err != nil {
+				return err
+			}
+			L.RawSet(-3)
+		}
+		return nil
+
+	case reflect.Struct:
+		fields := luaFieldsOf(v.Type())
+		L.CreateTable(0, len(fields))
+		for _, f := range fields {
+			fv, ok := fieldByIndex(v, f.index)
+			if !ok {
+				continue
+			}
+			fpath := f.name
+			if path != "" {
+				fpath = path + "." + f.name
+			}
+			L.PushString(f.name)
+			if err := e.push(fv, depth+1, fpath); err != nil {
+				return err
+			}
+			L.RawSet(-3)
+		}
+		return nil
+	}
+
+	return e.errorf(path, "unsupported type %s", v.Type())
+}
+
+func (e *valueEncoder) pushSequence(v reflect.Value, depth int, path string) error {
+	L := e.L
+	n := v.Len()
+	L.CreateTable(n, 0)
+	for i := 0; i < n; i++ {
+		if err := e.push(v.Index(i), depth+1, fmt.Sprintf("%s[%d]", path, i+1)); err != nil {
+			return err
+		}
+		L.RawSeti(-2, i+1)
+	}
+	return nil
+}
+
+// Pushes a map key, only scalar keys are accepted
+func (e *valueEncoder) pushKey(k reflect.Value, path string) error {
+	for k.Kind() == reflect.Interface || k.Kind() == reflect.Ptr {
+		if k.IsNil() {
+			return e.errorf(path, "nil map key")
+		}
+		k = k.Elem()
+	}
+	switch k.Kind() {
+	case reflect.Float32, reflect.Float64:
+		if math.IsNaN(k.Float()) {
+			return e.errorf(path, "NaN map key")
+		}
+		fallthrough
+	case reflect.Bool, reflect.String,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return e.push(k, 0, path)
+	}
+	return e.errorf(path, "unsupported map key type %s", k.Type())
+}
+
+// Error returned by ToValue when a lua value doesn't match the go type
+// it is being decoded into
+type ConversionError struct {
+	// Path of the offending value, for example "servers[3].port"
+	Path string
+	// Expected lua type
+	Expected string
+	// Lua type actually found, or a description of the problem
+	Got string
+}
+
+func (err *ConversionError) Error() string {
+	msg := "expected " + err.Expected + ", got " + err.Got
+	if err.Path == "" {
+		return msg
+	}
+	return err.Path + ": " + msg
+}
+
+// Converts a relative stack index into an absolute one
+func (L *State) absIndex(index int) int {
+	if index < 0 && index > LUA_REGISTRYINDEX {
+		return L.GetTop() + index + 1
+	}
+	return index
+}
+
+// Decodes the lua value at index into the go value pointed to by ptr.
+//
+// The conversion is driven by the go type: structs are filled from tables
+// using the same field names as PushGoValue (fields that are nil in lua
+// keep their value or get the default from their `lua:"name,default"`
+// tag), slices are filled from sequences, maps from tables and pointers
+// are allocated as needed. Values pushed with PushGoStruct are assigned
+// directly when their type matches.
+//
+// Type mismatches are reported as a *ConversionError naming the path of
+// the offending value.
+func (L *State) ToValue(index int, ptr interface{}) error {
+	rv := reflect.ValueOf(ptr)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("lua: ToValue requires a non-nil pointer, got %T", ptr)
+	}
+	return L.decodeValue(L.absIndex(index), rv.Elem(), "")
+}
+
+func (L *State) conversionError(index int, expected string, path string) error {
+	return &ConversionError{path, expected, L.LTypename(index)}
+}
+
+func (L *State) decodeValue(index int, v reflect.Value, path string) error {
+	if L.IsGoStruct(index) {
+		if gv := reflect.ValueOf(L.ToGoStruct(index)); gv.IsValid() && gv.Type().AssignableTo(v.Type()) {
+			v.Set(gv)
+			return nil
+		}
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr:
+		if L.IsNil(index) {
+			v.Set(reflect.Zero(v.Type()))
+			return nil
+		}
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return L.decodeValue(index, v.Elem(), path)
+
+	case reflect.Interface:
+		if v.NumMethod() == 0 {
+			x, err := L.decodeInterface(index, path, 0)
+			if err != nil {
+				return err
+			}
+			if x == nil {
+				v.Set(reflect.Zero(v.Type()))
+			} else {
+				v.Set(reflect.ValueOf(x))
+			}
+			return nil
+		}
+		if L.IsNil(index) {
+			v.Set(reflect.Zero(v.Type()))
+			return nil
+		}
+		return L.conversionError(index, v.Type().String(), path)
+
+	case reflect.Bool:
+		if L.Type(index) != LUA_TBOOLEAN {
+			return L.conversionError(index, "boolean", path)
+		}
+		v.SetBool(L.ToBoolean(index))
+		return nil
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := L.decodeInteger(index, path)
+		if err != nil {
+			return err
+		}
+		if v.OverflowInt(i) {
+			return &ConversionError{path, "integer", fmt.Sprintf("%d (overflows %s)", i, v.Type())}
+		}
+		v.SetInt(i)
+		return nil
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		i, err := L.decodeInteger(index, path)
+		if err != nil {
+			return err
+		}
+		if i < 0 || v.OverflowUint(uint64(i)) {
+			return &ConversionError{path, "integer", fmt.Sprintf("%d (overflows %s)", i, v.Type())}
+		}
+		v.SetUint(uint64(i))
+		return nil
+
+	case reflect.Float32, reflect.Float64:
+		if L.Type(index) != LUA_TNUMBER {
+			return L.conversionError(index, "number", path)
+		}
+		v.SetFloat(L.ToNumber(index))
+		return nil
+
+	case reflect.String:
+		if L.Type(index) != LUA_TSTRING {
+			return L.conversionError(index, "string", path)
+		}
+		v.SetString(L.ToString(index))
+		return nil
+
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 && L.Type(index) == LUA_TSTRING {
+			v.SetBytes(L.ToBytes(index))
+			return nil
+		}
+		if L.IsNil(index) {
+			v.Set(reflect.Zero(v.Type()))
+			return nil
+		}
+		if !L.IsTable(index) {
+			return L.conversionError(index, "table", path)
+		}
+		n := int(L.ObjLen(index))
+		s := reflect.MakeSlice(v.Type(), n, n)
+		if err := L.decodeSequence(index, s, path); err != nil {
+			return err
+		}
+		v.Set(s)
+		return nil
+
+	case reflect.Array:
+		if !L.IsTable(index) {
+			return L.conversionError(index, "table", path)
+		}
+		n := int(L.ObjLen(index))
+		if n > v.Len() {
+			return &ConversionError{path, fmt.Sprintf("at most %d elements", v.Len()), fmt.Sprintf("%d", n)}
+		}
+		// the elements missing from the table are left zero
+		for i := n; i < v.Len(); i++ {
+			v.Index(i).Set(reflect.Zero(v.Type().Elem()))
+		}
+		return L.decodeSequence(index, v.Slice(0, n), path)
+
+	case reflect.Map:
+		if L.IsNil(index) {
+			v.Set(reflect.Zero(v.Type()))
+			return nil
+		}
+		if !L.IsTable(index) {
+			return L.conversionError(index, "table", path)
+		}
+		if !L.CheckStack(3) {
+			return &ConversionError{path, "table", "lua stack overflow"}
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+		kt, et := v.Type().Key(), v.Type().Elem()
+		L.PushNil()
+		for L.Next(index) != 0 {
+			k := reflect.New(kt).Elem()
+			kpath := fmt.Sprintf("%s[%s]", path, L.keyString(-2))
+			if err := L.decodeValue(L.GetTop()-1, k, kpath+" (key)"); err != nil {
+				L.Pop(2)
+				return err
+			}
+			e := reflect.New(et).Elem()
+			if err := L.decodeValue(L.GetTop(), e, kpath); err != nil {
+				L.Pop(2)
+				return err
+			}
+			v.SetMapIndex(k, e)
+			L.Pop(1)
+		}
+		return nil
+
+	case reflect.Struct:
+		if !L.IsTable(index) {
+			return L.conversionError(index, "table", path)
+		}
+		if !L.CheckStack(2) {
+			return &ConversionError{path, "table", "lua stack overflow"}
+		}
+		for _, f := range luaFieldsOf(v.Type()) {
+			fv, ok := settableField(v, f.index)
+			if !ok {
+				continue
+			}
+			fpath := f.name
+			if path != "" {
+				fpath = path + "." + f.name
+			}
+			L.GetField(index, f.name)
+			var err error
+			if L.IsNil(-1) {
+				if f.hasDefault {
+					err = decodeDefault(fv, f.def, fpath)
+				}
+			} else {
+				err = L.decodeValue(L.GetTop(), fv, fpath)
+			}
+			L.Pop(1)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	return &ConversionError{path, v.Type().String(), "unsupported go type"}
+}
+
+// Like fieldByIndex but allocates nil embedded pointers, ok is false for
+// fields that can not be set
+func settableField(v reflect.Value, index []int) (f reflect.Value, ok bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				if !v.CanSet() {
+					return reflect.Value{}, false
+				}
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, v.CanSet()
+}
+
+func (L *State) decodeSequence(index int, v reflect.Value, path string) error {
+	if !L.CheckStack(2) {
+		return &ConversionError{path, "table", "lua stack overflow"}
+	}
+	for i := 0; i < v.Len(); i++ {
+		L.RawGeti(index, i+1)
+		err := L.decodeValue(L.GetTop(), v.Index(i), fmt.Sprintf("%s[%d]", path, i+1))
+		L.Pop(1)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (L *State) decodeInteger(index int, path string) (int64, error) {
+	if L.Type(index) != LUA_TNUMBER {
+		return 0, L.conversionError(index, "integer", path)
+	}
+	if i, ok := L.toInt64(index); ok {
+		return i, nil
+	}
+	n := L.ToNumber(index)
+	if n != math.Trunc(n) || n < math.MinInt64 || n >= math.MaxInt64 {
+		return 0, &ConversionError{path, "integer", fmt.Sprintf("number %v", n)}
+	}
+	return int64(n), nil
+}
+
+// Describes the key at index for error paths without converting it in place
+func (L *State) keyString(index int) string {
+	switch L.Type(index) {
+	case LUA_TSTRING:
+		return fmt.Sprintf("%q", L.ToString(index))
+	case LUA_TNUMBER:
+		return fmt.Sprintf("%v", L.ToNumber(index))
+	case LUA_TBOOLEAN:
+		return fmt.Sprintf("%v", L.ToBoolean(index))
+	}
+	return L.LTypename(index)
+}
+
+// Converts the lua value at index into a plain go value: nil, bool,
+// int64, float64, string, []interface{} for sequences,
+// map[string]interface{} for tables with string keys and
+// map[interface{}]interface{} for other tables
+func (L *State) decodeInterface(index int, path string, depth int) (interface{}, error) {
+	switch L.Type(index) {
+	case LUA_TNIL, LUA_TNONE:
+		return nil, nil
+	case LUA_TBOOLEAN:
+		return L.ToBoolean(index), nil
+	case LUA_TNUMBER:
+		if i, ok := L.toInt64(index); ok {
+			return i, nil
+		}
+		n := L.ToNumber(index)
+		if n == math.Trunc(n) && n >= math.MinInt64 && n < math.MaxInt64 {
+			return int64(n), nil
+		}
+		return n, nil
+	case LUA_TSTRING:
+		return L.ToString(index), nil
+	case LUA_TUSERDATA:
+		if L.IsGoStruct(index) {
+			return L.ToGoStruct(index), nil
+		}
+	case LUA_TTABLE:
+		if depth >= DefaultMaxPushDepth {
+			return nil, &ConversionError{path, "table", "table nested too deeply"}
+		}
+		if !L.CheckStack(3) {
+			return nil, &ConversionError{path, "table", "lua stack overflow"}
+		}
+		return L.decodeTable(index, path, depth)
+	}
+	return nil, L.conversionError(index, "nil, boolean, number, string or table", path)
+}
+
+// Pushes u as an integer, or as a float if it doesn't fit in one
+func (L *State) pushUint(u uint64) {
+	if u > math.MaxInt64 {
+		L.PushNumber(float64(u))
+	} else {
+		L.PushInteger(int64(u))
+	}
+}
+
+// Converts the values from index to the top of the stack with
+// decodeInterface
+func (L *State) decodeResults(index int) ([]interface{}, error) {
+	results := make([]interface{}, L.GetTop()-index+1)
+	for i := range results {
+		v, err := L.decodeInterface(index+i, fmt.Sprintf("result %d", i+1), 0)
+		if err != nil {
+			return nil, err
+		}
+		results[i] = v
+	}
+	return results, nil
+}
+
+func (L *State) decodeTable(index int, path string, depth int) (interface{}, error) {
+	n := int(L.ObjLen(index))
+	count := 0
+	allStrings := true
+	L.PushNil()
+	for L.Next(index) != 0 {
+		count++
+		if L.Type(-2) != LUA_TSTRING {
+			allStrings = false
+		}
+		L.Pop(1)
+	}
+
+	if count == n && n > 0 {
+		s := make([]interface{}, n)
+		for i := range s {
+			L.RawGeti(index, i+1)
+			x, err := L.decodeInterface(L.GetTop(), fmt.Sprintf("%s[%d]", path, i+1), depth+1)
+			L.Pop(1)
+			if err != nil {
+				return nil, err
+			}
+			s[i] = x
+		}
+		return s, nil
+	}
+
+	var sm map[string]interface{}
+	var im map[interface{}]interface{}
+	if allStrings {
+		sm = make(map[string]interface{}, count)
+	} else {
+		im = make(map[interface{}]interface{}, count)
+	}
+	L.PushNil()
+	for L.Next(index) != 0 {
+		kpath := fmt.Sprintf("%s[%s]", path, L.keyString(-2))
+		k, err := L.decodeInterface(L.GetTop()-1, kpath+" (key)", depth+1)
+		if err == nil {
+			var x interface{}
+			x, err = L.decodeInterface(L.GetTop(), kpath, depth+1)
+			if sm != nil {
+				sm[k.(string)] = x
+			} else if err == nil {
+				if reflect.TypeOf(k).Comparable() {
+					im[k] = x
+				} else {
+					err = &ConversionError{kpath + " (key)", "boolean, number or string", "table"}
+				}
+			}
+		}
+		if err != nil {
+			L.Pop(2)
+			return nil, err
+		}
+		L.Pop(1)
+	}
+	if sm != nil {
+		return sm, nil
+	}
+	return im, nil
+}
+
+// Parses the default value of a struct tag into v
+func decodeDefault(v reflect.Value, def string, path string) error {
+	var err error
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(def)
+		return nil
+	case reflect.Ptr:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return decodeDefault(v.Elem(), def, path)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var i int64
+		if i, err = strconv.ParseInt(def, 10, v.Type().Bits()); err == nil {
+			v.SetInt(i)
+			return nil
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		var u uint64
+		if u, err = strconv.ParseUint(def, 10, v.Type().Bits()); err == nil {
+			v.SetUint(u)
+			return nil
+		}
+	case reflect.Float32, reflect.Float64:
+		var f float64
+		if f, err = strconv.ParseFloat(def, v.Type().Bits()); err == nil {
+			v.SetFloat(f)
+			return nil
+		}
+	case reflect.Bool:
+		var b bool
+		if b, err = strconv.ParseBool(def); err == nil {
+			v.SetBool(b)
+			return nil
+		}
+	}
+	return &ConversionError{path, v.Type().String(), fmt.Sprintf("invalid default %q", def)}
+}